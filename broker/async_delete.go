@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"context"
+	"sync"
+
+	"github.com/99designs/cmdstalk/bs"
+)
+
+// deleter deletes jobs for AsyncDeletes in its own goroutine, on the
+// connection each was reserved on, so the worker can reserve its next job
+// meanwhile.
+type deleter struct {
+	jobs    chan pendingDelete
+	pending sync.WaitGroup
+	done    chan struct{}
+}
+
+// pendingDelete is a job queued for deletion, with what to emit once done.
+type pendingDelete struct {
+	ctx    context.Context
+	job    bs.Job
+	result JobResult
+}
+
+// startDeleter starts the worker's deleter, if AsyncDeletes is set.
+func (b *Broker) startDeleter() {
+	if b.AsyncDeletes <= 0 {
+		return
+	}
+	d := &deleter{
+		jobs: make(chan pendingDelete, b.AsyncDeletes),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(d.done)
+		for p := range d.jobs {
+			b.deleteNow(p)
+			d.pending.Done()
+		}
+	}()
+	b.deleter = d
+}
+
+// queueDelete queues the job for deletion, waiting while AsyncDeletes are
+// already outstanding.
+func (b *Broker) queueDelete(ctx context.Context, job bs.Job, result *JobResult) {
+	b.logEvent(actionFields(job, Delete), "queueing job %d for deletion", job.Id)
+	b.deleter.pending.Add(1)
+	b.deleter.jobs <- pendingDelete{ctx: ctx, job: job, result: *result}
+}
+
+// deleteNow deletes a queued job. A failure can't be returned to the
+// worker; a lost connection is found by its next reserve instead.
+func (b *Broker) deleteNow(p pendingDelete) {
+	defer func() {
+		b.recoverHook(recover(), p.job.Id)
+	}()
+	b.logEvent(actionFields(p.job, Delete), "deleting job %d", p.job.Id)
+	err := b.retry(p.job, Delete, p.job.Delete)
+	if b.jobLost(p.job, Delete, err) {
+		return
+	}
+	if err != nil {
+		b.setLastError(err)
+		b.logEvent(logFields{"job_id": p.job.Id, "error": err.Error()}, "async delete failed: %s", err)
+		return
+	}
+	b.metrics().IncrDeleted()
+	b.emit(p.ctx, PhaseDelete, &p.result)
+}
+
+// flushDeletes waits for queued deletes to finish, before their connection
+// is closed.
+func (b *Broker) flushDeletes() {
+	if b.deleter != nil {
+		b.deleter.pending.Wait()
+	}
+}
+
+// stopDeleter flushes queued deletes and stops the deleter.
+func (b *Broker) stopDeleter() {
+	if b.deleter == nil {
+		return
+	}
+	close(b.deleter.jobs)
+	<-b.deleter.done
+	b.deleter = nil
+}
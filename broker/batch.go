@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"bytes"
+
+	"github.com/99designs/cmdstalk/bs"
+)
+
+// SplitLines is a BatchSplit for newline-separated records, ignoring empty
+// lines.
+func SplitLines(body []byte) [][]byte {
+	var records [][]byte
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(line) > 0 {
+			records = append(records, line)
+		}
+	}
+	return records
+}
+
+// execute the command for the job once, with stdin.
+func (b *Broker) execute(job bs.Job, info *JobInfo, stdin []byte, shellCmd string) (*JobResult, error) {
+	if b.Persistent {
+		return b.executePersistent(job, stdin)
+	}
+	return b.executeJob(job, info, stdin, shellCmd)
+}
+
+// executeBatch executes the command for each record BatchSplit finds in
+// body, stopping at the first which doesn't exit 0.
+func (b *Broker) executeBatch(job bs.Job, info *JobInfo, body []byte, shellCmd string) (result *JobResult, err error) {
+	var records [][]byte
+	inHook("BatchSplit", func() { records = b.BatchSplit(body) })
+	result = &JobResult{JobId: job.Id}
+
+	var stdout []byte
+	var stderr string
+	completed := 0
+	for _, record := range records {
+		stdin := record
+		if b.StdinBuilder != nil {
+			var buildErr error
+			inHook("StdinBuilder", func() { stdin, buildErr = b.StdinBuilder(*info, record) })
+			if buildErr != nil {
+				b.logf("building stdin for job %d record %d failed: %s", job.Id, completed+1, buildErr)
+				result = &JobResult{JobId: job.Id, Error: buildErr, ExitStatus: -1}
+				break
+			}
+		}
+
+		started, duration := result.StartedAt, result.Duration
+		if result, err = b.execute(job, info, stdin, shellCmd); err != nil {
+			return
+		}
+		if completed > 0 {
+			result.StartedAt = started
+		}
+		result.Duration += duration
+		stdout = append(stdout, result.Stdout...)
+		stderr += result.Stderr
+		if !recordSucceeded(result) {
+			break
+		}
+		completed++
+	}
+
+	result.Stdout, result.Stderr = stdout, stderr
+	result.BatchRecords, result.BatchCompleted = len(records), completed
+	return
+}
+
+// recordSucceeded reports whether a batch record's command exited 0 of its
+// own accord.
+func recordSucceeded(r *JobResult) bool {
+	return r.ExitStatus == 0 && !r.Signaled && r.Err == nil &&
+		!r.TimedOut && !r.JobTimedOut && !r.Cancelled && !r.StalledIO
+}
@@ -5,9 +5,24 @@
 package broker
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"math"
+	"math/rand"
 	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/99designs/cmdstalk/bs"
@@ -21,6 +36,10 @@ const (
 	// We need to set our SIGTERM timer to time-left + ttrMargin.
 	ttrMargin = 1 * time.Second
 
+	// workerCloseTimeout is how long a persistent worker is given to exit
+	// once its stdin is closed, if KillGrace is not set.
+	workerCloseTimeout = 10 * time.Second
+
 	// TimeoutTries is the number of timeouts a job must reach before it is
 	// buried. Zero means never execute.
 	TimeoutTries = 1
@@ -28,6 +47,121 @@ const (
 	// ReleaseTries is the number of releases a job must reach before it is
 	// buried. Zero means never execute.
 	ReleaseTries = 10
+
+	// DefaultPriority is used when a job's priority stat can't be parsed.
+	DefaultPriority = 1024
+
+	// TruncatedMarker is appended to JobResult.Stdout when it is truncated
+	// to Broker.MaxStdoutBytes.
+	TruncatedMarker = "\n[truncated]"
+
+	// DefaultReserveTimeout is used when Broker.ReserveTimeout is zero.
+	DefaultReserveTimeout = 24 * time.Hour
+
+	// ContextReserveTimeout is used when Broker.ReserveTimeout is zero and
+	// RunContext is given a cancellable context.
+	ContextReserveTimeout = 1 * time.Second
+
+	// DefaultReconnectDelay is used when Broker.ReconnectDelay is zero.
+	DefaultReconnectDelay = 1 * time.Second
+
+	// DefaultReconnectMaxDelay is used when Broker.ReconnectMaxDelay is zero.
+	DefaultReconnectMaxDelay = 1 * time.Minute
+
+	// DefaultPollInterval is used when Broker.PollInterval is zero.
+	DefaultPollInterval = 1 * time.Second
+
+	// DefaultPollMinInterval is used when Broker.PollMinInterval is zero.
+	DefaultPollMinInterval = 100 * time.Millisecond
+
+	// DefaultActionRetryDelay is used when Broker.ActionRetryDelay is zero.
+	DefaultActionRetryDelay = 100 * time.Millisecond
+
+	// ExitTempFail is the conventional exit status (EX_TEMPFAIL) for
+	// Broker.RetryAfterExitStatus.
+	ExitTempFail = 75
+
+	// RetryAfterPrefix starts a line of worker stdout giving the delay to
+	// release the job with, e.g. "retry-after: 30s".
+	RetryAfterPrefix = "retry-after:"
+
+	// ExitCommandNotFound is the JobResult.ExitStatus recorded when the
+	// command can't be started, matching the shell's own exit status.
+	ExitCommandNotFound = 127
+)
+
+// Action is taken on a job after its worker exits.
+type Action int
+
+const (
+	// NoAction is the zero value, meaning no action was decided on.
+	NoAction Action = iota
+
+	// Delete the job.
+	Delete
+
+	// Release the job with an exponential-backoff delay and its original
+	// priority.
+	Release
+
+	// Bury the job with its original priority.
+	Bury
+)
+
+func (a Action) String() string {
+	switch a {
+	case NoAction:
+		return "none"
+	case Delete:
+		return "delete"
+	case Release:
+		return "release"
+	case Bury:
+		return "bury"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// DefaultActionFor deletes on exit(0), releases on exit(1) and buries on any
+// other exit status.
+func DefaultActionFor(exitStatus int) Action {
+	switch exitStatus {
+	case 0:
+		return Delete
+	case 1:
+		return Release
+	default:
+		return Bury
+	}
+}
+
+// BodyVia is how the job body is passed to the worker.
+type BodyVia int
+
+const (
+	// BodyViaStdin writes the body to the worker's stdin.
+	BodyViaStdin BodyVia = iota
+
+	// BodyViaTempFile writes the body to a temporary file, removed after the
+	// worker exits, whose path is in the worker's BEANSTALK_JOB_FILE
+	// environment variable. The worker's stdin is empty.
+	BodyViaTempFile
+)
+
+// ResultsPolicy is how a Broker sends to a results channel which isn't
+// ready to receive.
+type ResultsPolicy int
+
+const (
+	// ResultsBlock waits until the result is received.
+	ResultsBlock ResultsPolicy = iota
+
+	// ResultsDrop discards the result immediately.
+	ResultsDrop
+
+	// ResultsTimeoutDrop waits up to Broker.ResultsTimeout, then discards
+	// the result.
+	ResultsTimeoutDrop
 )
 
 type Broker struct {
@@ -35,14 +169,612 @@ type Broker struct {
 	// Address of the beanstalkd server.
 	Address string
 
-	// The shell command to execute for each job.
+	// The shell command to execute for each job. It is passed as the final
+	// argument after Shell, e.g. `/bin/bash -c "$Cmd"`.
 	Cmd string
 
+	// CmdTemplate, if set, is a text/template rendered for each job to
+	// produce the shell command used in place of Cmd. It is given .JobId,
+	// .Tube, .Priority and .Stats, the job's stats-job, and a quote function
+	// to quote values for the shell, e.g. `process --job {{.JobId}}`. If
+	// rendering fails the job is released. It doesn't apply to Command or
+	// Persistent.
+	CmdTemplate string
+
+	// CmdByTube maps tube names to shell commands used in place of Cmd, and
+	// of CmdTemplate, for jobs reserved from that tube, e.g. when watching
+	// several Tubes. Jobs from other tubes use Cmd. It doesn't apply to
+	// Command or Persistent.
+	CmdByTube map[string]string
+
+	// Command is executed directly, without a shell, in place of Cmd if it
+	// is not empty. Command[0] is the program and the rest its arguments.
+	Command []string
+
+	// Persistent starts the command once, and hands it each job over its
+	// stdin and stdout using the framing described by cmd.Process, instead
+	// of executing it per job. The status in its response is mapped to an
+	// action like an exit status. If the process dies or misbehaves it is
+	// killed and restarted for the next job, and the job in progress is
+	// released. JobTimeout, TTR and CancelJob kill the process likewise.
+	// Per-job environment variables, BodyVia, KeepAlive and the stdin and
+	// stdout timeouts don't apply.
+	Persistent bool
+
+	// Shell is the command and arguments which Cmd is appended to.
+	// Empty means ShellPath followed by ShellArgs.
+	Shell []string
+
+	// ShellArgs are the arguments given to ShellPath before Cmd when Shell
+	// is empty, e.g. []string{"-l", "-c"} to run a login shell which loads
+	// /etc/profile. The last must be -c, or combine it as in "-lc", since
+	// Cmd is always the final argument. Empty means []string{"-c"}.
+	ShellArgs []string
+
+	// ShellPath is the bash executable used when Shell is empty. New sets it
+	// to bash as found on PATH, falling back to cmd.Shell if that exists.
+	// Empty means cmd.Shell.
+	ShellPath string
+
+	// ShellDisabled executes Cmd directly without a shell, splitting it into
+	// arguments on whitespace. Shell is ignored.
+	ShellDisabled bool
+
+	// LimitCPU and LimitMemory, if positive, cap the CPU time and virtual
+	// memory (RLIMIT_CPU and RLIMIT_AS) of each command, and so of any
+	// processes it starts. CPU time is in whole seconds, rounded up. A
+	// command exceeding LimitCPU is killed by SIGXCPU or SIGKILL, and one
+	// exceeding LimitMemory has its allocations fail, usually exiting
+	// non-zero; either way the job is handled as failed by ActionFor or
+	// SignaledAction. Limits are applied by /bin/sh's ulimit before the
+	// command is exec'd, so need a Unix system; they are best supported on
+	// Linux. A Persistent command's CPU time accumulates across jobs.
+	LimitCPU    time.Duration
+	LimitMemory uint64
+
+	// TLSConfig, if set, is used to connect to beanstalkd over TLS.
+	TLSConfig *tls.Config
+
+	// ConnectHook, if set, is called with each new connection before it is
+	// used, e.g. to authenticate with a proxy in front of beanstalkd. An
+	// error is treated as a failure to connect, and retried likewise.
+	ConnectHook func(conn *beanstalk.Conn) error
+
+	// OnStart, if set, is called once by Run before any job is reserved,
+	// e.g. to prime caches or check the worker's dependencies are available.
+	// It runs once per broker, not per job, and not again on reconnect or
+	// for each Concurrency worker. If it returns an error, Run returns it
+	// without reserving anything.
+	OnStart func() error
+
 	// Tube name this broker will service.
 	Tube string
 
-	log     *log.Logger
-	results chan<- *JobResult
+	// Tubes this broker will service, replacing Tube if not empty.
+	Tubes []string
+
+	// ReserveTimeout is how long each reserve waits for a job before the
+	// broker loop wakes up, checks for cancellation, and reserves again.
+	// Zero means DefaultReserveTimeout, or ContextReserveTimeout if
+	// RunContext is given a cancellable context.
+	ReserveTimeout time.Duration
+
+	// HeartbeatInterval, if positive, is how often an idle broker logs that
+	// it is still watching its tubes, so that it can be told apart from a
+	// hung one. ReserveTimeout is capped to it. Zero logs nothing.
+	HeartbeatInterval time.Duration
+
+	// ReserveTimeoutTTRFactor, if positive, derives the reserve timeout from
+	// the tubes' TTR: on startup the TTR of the next ready job in each tube
+	// is sampled, and the largest multiplied by this factor is used.
+	// beanstalkd has no per-tube default TTR, so if no tube has a ready job
+	// ReserveTimeout, or its default, is used instead.
+	ReserveTimeoutTTRFactor float64
+
+	// PollIdle checks stats-tube for ready jobs before reserving, sleeping
+	// for PollInterval while every tube is empty, rather than blocking in a
+	// long reserve. The connection stays open, but the server holds no
+	// waiting reserve for it. This adds up to PollInterval latency.
+	PollIdle bool
+
+	// SleepWhilePaused stops reserving while every tube is paused with
+	// pause-tube, until the first resumes. Paused tubes are detected within
+	// PauseCheckInterval of the broker going idle, and logged regardless.
+	// It caps the reserve timeout at PauseCheckInterval.
+	SleepWhilePaused bool
+
+	// PollInterval is how often PollIdle checks empty tubes.
+	// Zero means DefaultPollInterval.
+	PollInterval time.Duration
+
+	// PollDelayed makes PollIdle, when no tube has a ready job but some
+	// have delayed ones, sleep until the soonest delayed job is due, as
+	// estimated by peek-delayed, instead of for PollInterval. The sleep is
+	// kept between PollMinInterval and PollMaxInterval. beanstalkd reports
+	// delays in whole seconds, so a job due within the second is polled for
+	// every PollMinInterval.
+	PollDelayed bool
+
+	// PollMinInterval bounds PollDelayed sleeps from below.
+	// Zero means DefaultPollMinInterval.
+	PollMinInterval time.Duration
+
+	// PollMaxInterval bounds PollDelayed sleeps from above, and is also
+	// the sleep when nothing is delayed. Zero means PollInterval, so that
+	// delayed jobs only shorten sleeps.
+	PollMaxInterval time.Duration
+
+	// ActionFor maps a worker exit status to the action taken on the job.
+	// nil means DefaultActionFor.
+	ActionFor func(exitStatus int) Action
+
+	// SuccessValidator, if set, is called with the result of each job whose
+	// command exits 0, and may override the action ActionFor chose, e.g. to
+	// release the job if Stderr shows a worker which doesn't set its exit
+	// status reported an error. NoAction keeps ActionFor's choice.
+	SuccessValidator func(result *JobResult) Action
+
+	// SlowJobThreshold, if positive, is how long a job's command may run
+	// before the job is reported as slow: logged, counted in
+	// BrokerStats.SlowJobs and by a Metrics implementing SlowMetrics, and
+	// passed to OnEvent as PhaseSlow. Its outcome is unaffected.
+	SlowJobThreshold time.Duration
+
+	// RetryAfterExitStatus, if not zero, is an exit status which releases
+	// the job with the delay given by the last RetryAfterPrefix line of its
+	// stdout, e.g. "retry-after: 30s" or "retry-after: 30". Without a valid
+	// line the job is released as usual. The line must be within
+	// MaxStdoutBytes. ExitTempFail is the conventional choice.
+	RetryAfterExitStatus int
+
+	// SignaledAction is taken on jobs whose command was killed by a signal
+	// other than by the broker itself, e.g. releasing them so that a job
+	// killed for memory can be retried elsewhere. NoAction means ActionFor
+	// decides, given exit status -1.
+	SignaledAction Action
+
+	// CommandNotFoundAction is taken on jobs whose command can't be
+	// started, e.g. a missing Command binary. NoAction means Bury.
+	CommandNotFoundAction Action
+
+	// ReleaseBackoff scales the delay of released jobs, which is
+	// ReleaseBackoff * releases^4. Zero means one second.
+	ReleaseBackoff time.Duration
+
+	// ReleaseBackoffMax caps the delay of released jobs.
+	// Zero means no cap.
+	ReleaseBackoffMax time.Duration
+
+	// ReleaseDelay is the minimum delay of released jobs, applied after
+	// ReleaseBackoffMax. Zero means the backoff delay alone is used, which
+	// is zero for a job's first release.
+	ReleaseDelay time.Duration
+
+	// Jitter, from 0 to 1, randomly shortens release and reconnect backoff
+	// delays by up to that fraction, so that brokers backing off at the same
+	// time spread out: 1 is "full jitter", anywhere from zero to the delay,
+	// and 0.5 is "equal jitter", from half the delay to all of it. Each
+	// broker and Concurrency worker has its own random source. Zero means
+	// no jitter.
+	Jitter float64
+
+	// ReleasePriority, if set, is the priority released jobs are given.
+	// nil means the priority the job was reserved with, plus
+	// ReleasePriorityOffset.
+	ReleasePriority *uint32
+
+	// ReleasePriorityOffset is added to the priority of released jobs,
+	// clamped to the valid range; positive values demote retries behind
+	// fresh jobs of the same priority. It accumulates over each release.
+	ReleasePriorityOffset int64
+
+	// BuryPriority, if set, is the priority buried jobs are given, and so
+	// the priority they return with when kicked. nil means the priority the
+	// job was reserved with.
+	BuryPriority *uint32
+
+	// MaxReleases is the number of releases a job must reach before it is
+	// buried. Zero means ReleaseTries.
+	MaxReleases uint64
+
+	// PoisonThreshold, if positive, gives up on jobs whose reserves,
+	// timeouts and releases add up to more than it, without executing them.
+	// They are buried, or moved to DeadLetterTube if set.
+	PoisonThreshold int
+
+	// ActionRetries is how many times a delete, release or bury failing with
+	// a transient beanstalkd error, such as OUT_OF_MEMORY, is retried. If it
+	// still fails the broker reconnects, which returns the job to the ready
+	// queue, rather than Run returning an error. Zero means no retries.
+	ActionRetries int
+
+	// ActionRetryDelay is the pause before the first retry, doubling for
+	// each one after. Zero means DefaultActionRetryDelay.
+	ActionRetryDelay time.Duration
+
+	// ResultsPolicy is how results are sent when the results channel isn't
+	// ready to receive. Dropped results are counted in
+	// BrokerStats.DroppedResults.
+	ResultsPolicy ResultsPolicy
+
+	// ResultsTimeout is how long ResultsTimeoutDrop waits to send a result.
+	ResultsTimeout time.Duration
+
+	// ResultWriter, if set, receives each JobResult as a line of JSON, in
+	// addition to the results channel. Writes happen on a separate
+	// goroutine; if they fall too far behind, results are dropped and
+	// logged rather than holding up jobs.
+	ResultWriter io.Writer
+
+	// OnResult, if set, is called with each JobResult, in addition to the
+	// results channel, as an alternative to managing one. It is called
+	// synchronously by the worker before it reserves its next job, so it
+	// should return promptly; with Concurrency > 1 it is called from
+	// multiple goroutines. It is called regardless of ResultsPolicy.
+	OnResult func(result *JobResult)
+
+	// Metrics, if set, receives job outcome counts and durations, in
+	// addition to the counters reported by Stats.
+	Metrics Metrics
+
+	// Pool, if set, provides connections for requests made outside the run
+	// loop, e.g. Put, Stats and Kick, instead of the broker dialing its own.
+	// It may be shared by many brokers. See Pool for what it can't cover.
+	Pool *Pool
+
+	// RateWindow is the sliding window over which Rate is computed.
+	// Zero means DefaultRateWindow.
+	RateWindow time.Duration
+
+	// Clock, if set, replaces the real clock for timeouts, delays and
+	// timestamps, e.g. in tests.
+	Clock Clock
+
+	// NewReserver, if set, replaces beanstalk.NewTubeSet for reserving jobs
+	// from the tubes on each new connection, e.g. in tests.
+	NewReserver func(conn *beanstalk.Conn, tubes ...string) bs.Reserver
+
+	// Dial, if set, replaces dialling Address for the connections jobs are
+	// reserved and handled on, e.g. to use a bs.Fake in tests. TLSConfig,
+	// ConnectHook and NewReserver only apply to dialled connections, and
+	// control requests such as Stats and Kick still dial Address.
+	Dial func() (bs.Conn, error)
+
+	// OnEvent, if set, is called synchronously at each transition of a
+	// job's lifecycle: reserve, start, finish, and delete, release or bury.
+	// With Concurrency > 1 it is called from multiple goroutines.
+	OnEvent func(ev Event)
+
+	// DryRun executes jobs as usual, but releases them with their original
+	// priority and no delay instead of deleting, releasing or burying them.
+	// JobResult.IntendedAction records what would have happened.
+	DryRun bool
+
+	// DumpDir, if set, drains the tubes to files instead of executing jobs:
+	// each ready job is reserved and its body written to DumpDir/<tube>-<id>.
+	// Dumped jobs stay reserved until none are left ready, MaxJobs is
+	// reached or Run is cancelled, so that each is dumped once, and are then
+	// released with their original priority and no delay. Jobs are never
+	// deleted or buried.
+	DumpDir string
+
+	// Transform, if set, is applied to each job body before it is written
+	// to the worker's stdin. If it returns an error the job is released, or
+	// buried if BuryOnTransformError, without the worker being executed.
+	Transform func(body []byte) ([]byte, error)
+
+	// BuryOnTransformError buries jobs which Transform or StdinBuilder
+	// fails on.
+	BuryOnTransformError bool
+
+	// StdinBuilder, if set, builds exactly what is written to the worker's
+	// stdin from the job's details and its body, after Transform. Errors are
+	// handled as for Transform. nil writes the body unchanged.
+	// With BatchSplit, it builds the stdin of each record instead.
+	StdinBuilder func(job JobInfo, body []byte) ([]byte, error)
+
+	// BatchSplit, if set, splits each job's body, after Transform, into
+	// records, and the command is executed once per record, in order, with
+	// the record as its stdin. The job is deleted only if every record
+	// exits 0. Otherwise no further records are executed and the job is
+	// released whole, so records which succeeded are executed again on the
+	// next attempt, and must be safe to repeat; if the failure was the TTR
+	// expiring, beanstalkd requeues the job as usual. A body with no records
+	// is deleted without executing anything. See SplitLines.
+	BatchSplit func(body []byte) [][]byte
+
+	// DeadLetterTube, if set, receives the body of jobs which have exhausted
+	// their releases or timeouts, instead of them being buried. The original
+	// job is deleted once the put succeeds.
+	DeadLetterTube string
+
+	// DeadLetterTransform builds the body put into DeadLetterTube from the
+	// original tube, failure count and body.
+	// nil means DefaultDeadLetterTransform.
+	DeadLetterTransform func(tube string, failures uint64, body []byte) []byte
+
+	// PipelineTube, if set, receives the stdout of each job which exits 0
+	// as the body of a new job, before the original is deleted. If the put
+	// fails the original is released instead. Stdout is subject to
+	// MaxStdoutBytes and MaxTotalStdoutBytes, so they should be left unset.
+	PipelineTube string
+
+	// PipelinePriority, if set, is the priority of jobs put into
+	// PipelineTube. nil means the original job's priority.
+	PipelinePriority *uint32
+
+	// PipelineDelay is the delay of jobs put into PipelineTube.
+	PipelineDelay time.Duration
+
+	// PipelineTTR is the TTR of jobs put into PipelineTube.
+	// Zero means the original job's TTR.
+	PipelineTTR time.Duration
+
+	// Concurrency is the number of jobs reserved and executed in parallel,
+	// each with its own connection to beanstalkd. Zero means one.
+	//
+	// With one, and Connections no more than one, jobs are handled strictly
+	// in the order they are reserved: each job's delete, release or bury,
+	// and its result being sent, complete before the next reserve, unless
+	// AsyncDeletes is set.
+	Concurrency int
+
+	// Connections, if greater than Concurrency, is the number of
+	// connections reserving jobs, each handling one job at a time, with at
+	// most Concurrency jobs executing at once. A job reserved while all are
+	// busy waits for one to finish, its TTR running meanwhile.
+	Connections int
+
+	// Limiter, if set, is shared with other brokers to cap the number of
+	// jobs executing at once across all of them. A reserved job waits for
+	// a slot, its TTR running meanwhile, before its command is started, and
+	// holds it until the job's delete, release or bury. With AsyncDeletes
+	// the slot is freed once the delete is queued, not once it is done,
+	// since it may wait behind the worker's next reserve. Waiting is only
+	// interrupted by cancelling RunContext's context, which releases the
+	// job unchanged; closing ticks takes effect once a slot is free.
+	Limiter *Limiter
+
+	// WorkDir is the worker's working directory.
+	// Empty means the broker's working directory.
+	WorkDir string
+
+	// Env holds "KEY=value" variables added to the environment the worker
+	// inherits from the broker.
+	Env []string
+
+	// BodyVia is how the job body is passed to the worker.
+	BodyVia BodyVia
+
+	// LogOutput is where the broker logs to. nil means os.Stdout; io.Discard
+	// silences it.
+	LogOutput io.Writer
+
+	// LogFlags, if set, replaces log.LstdFlags as the log's flags.
+	LogFlags *int
+
+	// LogPrefix starts each plain text log line. Empty means the tubes and
+	// slot, e.g. "[emails:0] ".
+	LogPrefix string
+
+	// JSONLogs writes log lines as JSON objects with fields such as tube,
+	// job_id, exit_status, action and duration_ms, instead of plain text.
+	JSONLogs bool
+
+	// NullStdinOnEmpty gives the command /dev/null as stdin, rather than an
+	// immediately closed pipe, when the job body is empty, e.g. for jobs
+	// where the tube alone is the signal. This includes BodyViaTempFile.
+	NullStdinOnEmpty bool
+
+	// DisableJobEnv stops the job id, tube, priority, releases and timeouts
+	// being passed to the worker as BEANSTALK_* environment variables,
+	// saving a stats-job request per job.
+	DisableJobEnv bool
+
+	// IncludeJobStats sets JobResult.Stats. The stats are read once per job
+	// regardless, for its tube, counts and environment variables; this only
+	// controls whether the result keeps them.
+	IncludeJobStats bool
+
+	// MaxStdoutBytes caps how much worker stdout is kept in JobResult.Stdout;
+	// the rest is discarded and TruncatedMarker appended. Zero means no cap.
+	MaxStdoutBytes int
+
+	// StdoutWriter, if set, receives all worker stdout as it is read,
+	// regardless of MaxStdoutBytes.
+	StdoutWriter io.Writer
+
+	// CaptureStdout, if set to false, gives the command /dev/null as stdout
+	// rather than reading it, to save buffering output which isn't wanted.
+	// JobResult.Stdout is then always empty, and StdoutWriter,
+	// StdoutReadTimeout, PipelineTube and retry-after lines get nothing.
+	// nil means true. It doesn't apply to Persistent.
+	CaptureStdout *bool
+
+	// StdinWriteTimeout, if positive, kills the command if it hasn't
+	// consumed the whole job body from stdin within this long of starting.
+	// The job is released, as for JobTimeout.
+	StdinWriteTimeout time.Duration
+
+	// StdoutReadTimeout, if positive, kills the command if its stdout is
+	// open but idle for this long. The job is released, as for JobTimeout.
+	StdoutReadTimeout time.Duration
+
+	// MaxTotalStdoutBytes caps the worker stdout buffered across all jobs in
+	// progress, including those of Concurrency workers, to bound memory use.
+	// It applies after MaxStdoutBytes: each job keeps at most that much, and
+	// only while the shared budget allows. Once the budget is exhausted
+	// further stdout is discarded without TruncatedMarker, and counted in
+	// BrokerStats.DiscardedStdoutBytes. A job's share of the budget is
+	// returned when it finishes. Zero means no cap.
+	MaxTotalStdoutBytes int
+
+	// MaxBodyBytes, if positive, rejects jobs with a larger body without
+	// executing them: they are moved to DeadLetterTube if set, otherwise
+	// buried, and counted in BrokerStats.RejectedJobs.
+	MaxBodyBytes int
+
+	// Throttle is a pause after each job before reserving the next, to limit
+	// the rate jobs are processed. Zero means no pause.
+	Throttle time.Duration
+
+	// MaxJobs is the number of jobs after which Run returns.
+	// Zero means unlimited.
+	MaxJobs int
+
+	// JobTimeout is how long a worker may run before it and its process
+	// group are killed and the job released. Zero means no timeout other
+	// than the job TTR.
+	JobTimeout time.Duration
+
+	// KillGrace, if positive, gives a worker exceeding JobTimeout a chance to
+	// clean up: KillSignal is sent to its process group first, and SIGKILL
+	// only if it is still running after KillGrace. Zero means SIGKILL
+	// straight away.
+	KillGrace time.Duration
+
+	// KillSignal is sent before KillGrace. Zero means SIGTERM.
+	KillSignal syscall.Signal
+
+	// KeepAlive touches each job while its worker runs, so that the job
+	// does not reach its TTR. The worker is then bounded only by JobTimeout.
+	KeepAlive bool
+
+	// TouchInterval is how often KeepAlive touches the job.
+	// Zero means half the job's TTR.
+	TouchInterval time.Duration
+
+	// Prefetch, if positive, is the number of jobs each worker reserves
+	// ahead, without waiting, while it handles the current one, saving a
+	// reserve round trip per job. Prefetched jobs are handled in the order
+	// they were reserved, and touched to keep them from reaching their TTR
+	// meanwhile, and again before being handled. They are held from other
+	// consumers until then, and only return to ready when the broker
+	// disconnects, so a slow job delays those queued behind it.
+	Prefetch int
+
+	// HealthTimeout is how long the broker may go without completing a
+	// reserve while idle before Healthy reports false. It should exceed
+	// ReserveTimeout. Zero means Healthy only checks the connection.
+	HealthTimeout time.Duration
+
+	// ReconnectDelay is the delay before the first attempt to redial
+	// beanstalkd after a connection failure, doubling after each further
+	// failed attempt. Zero means DefaultReconnectDelay.
+	ReconnectDelay time.Duration
+
+	// ReconnectPolicy, if set, varies the initial ReconnectDelay by the
+	// class of connection failure, e.g. backing off longer while beanstalkd
+	// refuses connections than after a reset.
+	ReconnectPolicy *ReconnectPolicy
+
+	// ReconnectMaxDelay caps the doubling of ReconnectDelay.
+	// Zero means DefaultReconnectMaxDelay.
+	ReconnectMaxDelay time.Duration
+
+	// ReconnectTries is the number of consecutive failed dials after which
+	// Run gives up and returns an error. Zero means retry forever.
+	ReconnectTries int
+
+	// AsyncDeletes, if positive, is the number of successful jobs whose
+	// deletes may be outstanding at once, issued in the background on the
+	// connection they were reserved on while the worker reserves its next
+	// job, saving a round trip per job. A worker waits for a free slot
+	// when all are in use; OnEvent sees PhaseDelete once the delete is done.
+	// A Limiter slot is freed once the delete is queued. Deletes are
+	// finished before reconnecting and before Run returns.
+	//
+	// beanstalkd handles a connection's commands in turn, so deletes queue
+	// behind a reserve which is waiting for a job; a reserved job nearing
+	// its TTR ends the wait with DEADLINE_SOON, letting its delete through.
+	AsyncDeletes int
+
+	// RecentResultsSize is the number of the latest results, from all
+	// workers, kept for RecentResults. Stdout is kept as captured, subject
+	// to MaxStdoutBytes. Zero keeps none.
+	RecentResultsSize int
+
+	cmdTemplate    *template.Template // from CmdTemplate, during RunContext
+	conn           bs.Conn
+	deleter        *deleter      // for AsyncDeletes, per worker
+	jobSlots       chan struct{} // shared by Connections workers
+	log            *log.Logger
+	pauseChecked   time.Time     // by checkPaused
+	pausedTubes    string        // as last logged by checkPaused
+	prefetched     []prefetched  // by Prefetch, per worker
+	reserveTimeout time.Duration // from ReserveTimeoutTTRFactor
+	results        chan<- *JobResult
+	rng            *rand.Rand    // for Jitter, per worker
+	resultWriter   *resultWriter // for ResultWriter, during RunContext
+	shared         *shared
+	shellErr       error // from lookupShell in New
+	slot           uint64
+	ts             bs.Reserver
+	worker         *cmd.Process // for Persistent, started by the first job
+}
+
+// shared is state shared between a Broker and its concurrent workers.
+type shared struct {
+
+	// jobs is the number of jobs reserved, or about to be.
+	jobs atomic.Uint64
+
+	// counters of job outcomes, reported by Stats.
+	counters Counters
+
+	// control is a connection for requests made outside the run loop.
+	control controlConn
+
+	// connected is the number of workers with a connection to beanstalkd.
+	connected atomic.Int64
+
+	// droppedResults is the number of results discarded by ResultsPolicy.
+	droppedResults atomic.Uint64
+
+	// busy is the number of workers handling a job.
+	busy atomic.Int64
+
+	// lastContact is when a reserve last completed, in Unix nanoseconds.
+	lastContact atomic.Int64
+
+	// stdoutBytes is the stdout buffered by jobs in progress, counted
+	// against MaxTotalStdoutBytes.
+	stdoutBytes atomic.Int64
+
+	// discardedStdout is the number of stdout bytes dropped because
+	// MaxTotalStdoutBytes was reached.
+	discardedStdout atomic.Uint64
+
+	// rejected is the number of jobs rejected by MaxBodyBytes.
+	rejected atomic.Uint64
+
+	// lostJobs is the number of actions which found the job gone.
+	lostJobs atomic.Uint64
+
+	// seeds counts random sources created, to vary their seeds.
+	seeds atomic.Uint64
+
+	// rate counts recently executed jobs for Rate.
+	rate rateWindow
+
+	// recent holds the last results for RecentResults.
+	recent recentResults
+
+	// recoveredPanics is the number of panics in hooks recovered from.
+	recoveredPanics atomic.Uint64
+
+	mu      sync.Mutex
+	lastErr error
+
+	// running maps the id of each job being executed to a channel closed
+	// by CancelJob. Guarded by mu.
+	running map[uint64]chan struct{}
+
+	// run is the RunContext in progress, if any, for Drain. Guarded by mu.
+	run *runState
+
+	// resume is closed by Resume, if Pause has been called. Guarded by mu.
+	resume chan struct{}
 }
 
 type JobResult struct {
@@ -50,145 +782,1014 @@ type JobResult struct {
 	// Buried is true if the job was buried.
 	Buried bool
 
+	// IntendedAction is the action decided on for the job, if any.
+	// In DryRun mode it is not performed.
+	IntendedAction Action
+
+	// DeadLettered is true if the job was moved to Broker.DeadLetterTube.
+	DeadLettered bool
+
+	// Rejected is true if the job's body exceeded Broker.MaxBodyBytes.
+	Rejected bool
+
+	// BatchRecords is the number of records Broker.BatchSplit found in the
+	// body, of which BatchCompleted exited 0 before one failed, if any.
+	// The rest of the result then describes the last record executed,
+	// except that Stdout, Stderr and Duration cover all of them.
+	BatchRecords   int
+	BatchCompleted int
+
 	// Executed is true if the job command was executed (or attempted).
 	Executed bool
 
+	// PipelineJobId is the id of the job put into Broker.PipelineTube with
+	// this job's stdout, if any.
+	PipelineJobId uint64
+
+	// RetryAfter is the release delay requested by the worker through
+	// Broker.RetryAfterExitStatus, if any.
+	RetryAfter time.Duration
+
+	// StalledIO is true if the command was killed for not consuming stdin
+	// within Broker.StdinWriteTimeout, or not writing stdout within
+	// Broker.StdoutReadTimeout.
+	StalledIO bool
+
+	// Cancelled is true if the command was killed by Broker.CancelJob.
+	Cancelled bool
+
+	// CommandNotFound is true if the command couldn't be started, in which
+	// case ExitStatus is ExitCommandNotFound and Error says why.
+	CommandNotFound bool
+
 	// ExitStatus of the command; 0 for success.
 	ExitStatus int
 
+	// Signaled is true if the command was killed by a signal, e.g. SIGKILL
+	// from the OOM killer, in which case ExitStatus is -1. A command run by
+	// Shell may instead exit with 128 plus the signal number, if the shell
+	// outlives it.
+	Signaled bool
+	Signal   syscall.Signal
+
 	// JobId from beanstalkd.
 	JobId uint64
 
+	// Reserves, Releases and Timeouts of the job according to beanstalkd
+	// when it was reserved, and its Age since it was put.
+	Reserves uint64
+	Releases uint64
+	Timeouts uint64
+	Age      time.Duration
+
+	// Tube the job was reserved from.
+	Tube string
+
+	// Stats is the job's stats-job as read when it was reserved, if
+	// Broker.IncludeJobStats is set.
+	Stats map[string]string
+
 	// Stdout of the command.
 	Stdout []byte
 
+	// Stderr of the command.
+	Stderr string
+
 	// TimedOut indicates the worker exceeded TTR for the job.
 	// Note this is tracked by a timer, separately to beanstalkd.
 	TimedOut bool
 
+	// StartedAt is when the command was started.
+	StartedAt time.Time
+
+	// Duration of the command, from starting it to it exiting.
+	Duration time.Duration
+
+	// JobTimedOut indicates the worker exceeded Broker.JobTimeout and was
+	// killed.
+	JobTimedOut bool
+
+	// GracefulStop is true if the worker exited within Broker.KillGrace of
+	// being sent Broker.KillSignal, rather than being killed.
+	GracefulStop bool
+
+	// Err is a failure to start the command or wait for it, other than a
+	// missing command. ExitStatus is -1 and the job is released.
+	Err error
+
 	// Error raised while attempting to handle the job.
 	Error error
 }
 
-// New broker instance.
-func New(address, tube string, slot uint64, cmd string, results chan<- *JobResult) (b Broker) {
-	b.Address = address
-	b.Tube = tube
-	b.Cmd = cmd
-
-	b.log = log.New(os.Stdout, fmt.Sprintf("[%s:%d] ", tube, slot), log.LstdFlags)
-	b.results = results
-	return
+// New broker instance. It is a thin wrapper over NewWithOptions whose
+// options aren't validated, so that e.g. Address may be left empty when
+// Dial is set. Its signature can't change to return an error, so a missing
+// shell is only reported by Run; NewWithOptions reports it up front.
+func New(address, tube string, slot uint64, cmd string, results chan<- *JobResult) Broker {
+	b, _ := newWithOptions(Options{Address: address, Tube: tube, Slot: slot, Cmd: cmd, Results: results})
+	return *b
 }
 
 // Run connects to beanstalkd and starts broking.
 // If ticks channel is present, one job is processed per tick.
-func (b *Broker) Run(ticks chan bool) {
-	b.log.Println("command:", b.Cmd)
-	b.log.Println("connecting to", b.Address)
-	conn, err := beanstalk.Dial("tcp", b.Address)
-	if err != nil {
-		panic(err)
+// Connection failures cause a reconnect; an error is returned if
+// ReconnectTries is exhausted, or for any other unrecoverable error.
+func (b *Broker) Run(ticks chan bool) error {
+	return b.RunContext(context.Background(), ticks)
+}
+
+// RunContext is like Run, but returns nil once ctx is cancelled, after
+// finishing any in-flight job and closing the connection. Unless
+// ReserveTimeout is set, reserves wait at most ContextReserveTimeout between
+// checks for cancellation.
+func (b *Broker) RunContext(ctx context.Context, ticks chan bool) error {
+	b.configureLog()
+	if b.shellErr != nil && b.ShellPath == "" && b.usesDefaultShell() {
+		return fmt.Errorf("%w: %w", ErrCommandStart, b.shellErr)
+	}
+	b.logf("command: %q", b.argv(b.Cmd))
+	for tube, shellCmd := range b.CmdByTube {
+		b.logf("command for %s: %q", tube, b.argv(shellCmd))
+	}
+	if b.WorkDir != "" {
+		if fi, err := os.Stat(b.WorkDir); err != nil {
+			return fmt.Errorf("work dir: %w", err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("work dir %s is not a directory", b.WorkDir)
+		}
+	}
+
+	if b.DumpDir != "" {
+		if fi, err := os.Stat(b.DumpDir); err != nil {
+			return fmt.Errorf("dump dir: %w", err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("dump dir %s is not a directory", b.DumpDir)
+		}
+	}
+
+	if b.CmdTemplate != "" {
+		t, err := parseCmdTemplate(b.CmdTemplate)
+		if err != nil {
+			return err
+		}
+		b.cmdTemplate = t
+		defer func() { b.cmdTemplate = nil }()
 	}
 
-	b.log.Println("watching", b.Tube)
-	ts := beanstalk.NewTubeSet(conn, b.Tube)
+	if b.OnStart != nil {
+		if err := b.OnStart(); err != nil {
+			return fmt.Errorf("on start: %w", err)
+		}
+	}
+
+	cancellable := ctx.Done() != nil
+	ctx, stop := context.WithCancel(ctx)
+	defer b.startRun(stop, cancellable)()
+
+	if b.ResultWriter != nil {
+		b.resultWriter = newResultWriter(b.ResultWriter, b.logf)
+		defer func() {
+			b.resultWriter.close()
+			b.resultWriter = nil
+		}()
+	}
+	workers := b.Concurrency
+	if b.Connections > workers {
+		b.jobSlots = make(chan struct{}, max(b.Concurrency, 1))
+		defer func() { b.jobSlots = nil }()
+		workers = b.Connections
+	}
+	if workers <= 1 {
+		return b.run(ctx, ticks)
+	}
+
+	// Each worker is a copy of the broker with its own connection, so that
+	// a blocking reserve never holds up another worker's job.
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		w := *b
+		go func() {
+			errs <- w.run(ctx, ticks)
+		}()
+	}
+
+	var err error
+	for i := 0; i < workers; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// RunWithSignals is like RunContext, with a context which is cancelled when
+// one of sigs is received; SIGTERM and SIGINT if none are given. The default
+// signal behavior is restored when it returns.
+func (b *Broker) RunWithSignals(ticks chan bool, sigs ...os.Signal) error {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), sigs...)
+	defer stop()
+	return b.RunContext(ctx, ticks)
+}
+
+// run reserves and handles one job at a time on a single connection.
+func (b *Broker) run(ctx context.Context, ticks chan bool) error {
+	b.rng = nil // not shared with other workers
+	b.startDeleter()
+	defer b.stopDeleter()
+	defer b.disconnect()
+	defer b.stopWorker(false)
+
+	if err := b.connect(ctx); err != nil {
+		return ignoreCancel(ctx, err)
+	}
+	if b.DumpDir != "" {
+		return b.dump(ctx, ticks)
+	}
+	if b.ReserveTimeoutTTRFactor > 0 {
+		if b.reserveTimeout = b.ttrReserveTimeout(); b.reserveTimeout > 0 {
+			b.logf("reserve timeout from TTR: %v", b.reserveTimeout)
+		} else {
+			b.logf("no ready job to sample TTR from, using default reserve timeout")
+		}
+	}
 
 	for {
 		if ticks != nil {
-			if _, ok := <-ticks; !ok {
-				break
+			select {
+			case _, ok := <-ticks:
+				if !ok {
+					b.logf("broker finished")
+					return nil
+				}
+			case <-ctx.Done():
+				b.logf("broker cancelled")
+				return nil
 			}
 		}
 
-		b.log.Println("reserve (waiting for job)")
-		id, body := bs.MustReserveWithoutTimeout(ts)
-		job := bs.NewJob(id, body, conn)
+		if b.MaxJobs > 0 && b.shared.jobs.Add(1) > uint64(b.MaxJobs) {
+			b.logf("reached %d jobs, finishing", b.MaxJobs)
+			return nil
+		}
 
-		t, err := job.Timeouts()
+		b.logEvent(logFields{"event": "reserve"}, "reserve (waiting for job)")
+		job, err := b.nextJob(ctx)
 		if err != nil {
-			b.log.Panic(err)
-		}
-		if t >= TimeoutTries {
-			b.log.Printf("job %d has %d timeouts, burying", job.Id, t)
-			job.Bury()
-			if b.results != nil {
-				b.results <- &JobResult{JobId: job.Id, Buried: true}
-			}
-			continue
+			return ignoreCancel(ctx, err)
 		}
 
-		releases, err := job.Releases()
-		if err != nil {
-			b.log.Panic(err)
+		if !b.acquireSlot(ctx, job) {
+			return nil
 		}
-		if releases >= ReleaseTries {
-			b.log.Printf("job %d has %d releases, burying", job.Id, releases)
-			job.Bury()
-			if b.results != nil {
-				b.results <- &JobResult{JobId: job.Id, Buried: true}
+		// processJob performs the job's delete, release or bury before
+		// returning, and nothing below is asynchronous, which keeps a single
+		// worker in reserve order; see Concurrency.
+		b.shared.busy.Add(1)
+		stopPrefetch := b.startPrefetch()
+		result, err := b.processJobRecovering(ctx, job)
+		stopPrefetch()
+		b.shared.busy.Add(-1)
+		b.recordRate(result)
+		b.releaseSlot()
+		if err != nil {
+			if result == nil {
+				result = &JobResult{JobId: job.Id}
 			}
-			continue
+			result.Error = err
 		}
 
-		b.log.Printf("executing job %d", job.Id)
-		result, err := b.executeJob(job, b.Cmd)
-		if err != nil {
-			log.Panic(err)
+		if result.Error != nil {
+			b.setLastError(result.Error)
+			b.logEvent(logFields{"job_id": job.Id, "error": result.Error.Error()}, "result had error: %s", result.Error)
 		}
 
-		err = b.handleResult(job, result)
+		b.sendResult(result)
+
 		if err != nil {
-			log.Panic(err)
+			var actionErr *actionError
+			if !bs.ConnectionLost(err) && !errors.As(err, &actionErr) {
+				return &JobError{JobId: job.Id, Err: err}
+			}
+			if err = b.reconnect(ctx); err != nil {
+				return ignoreCancel(ctx, err)
+			}
 		}
 
-		if result.Error != nil {
-			b.log.Println("result had error:", result.Error)
+		if b.Throttle > 0 {
+			select {
+			case <-b.clock().After(b.Throttle):
+			case <-ctx.Done():
+			}
 		}
+	}
+}
 
-		if b.results != nil {
-			b.results <- result
+// acquireSlot waits for one of the Concurrency slots shared by Connections
+// workers, if any, then for a slot from Limiter, if set. If ctx is
+// cancelled first the job is released unchanged and false returned.
+func (b *Broker) acquireSlot(ctx context.Context, job bs.Job) bool {
+	if b.jobSlots != nil {
+		select {
+		case b.jobSlots <- struct{}{}:
+		case <-ctx.Done():
+			b.releaseCancelled(job)
+			return false
 		}
 	}
-
-	b.log.Println("broker finished")
+	if b.Limiter != nil {
+		if err := b.Limiter.Acquire(ctx); err != nil {
+			if b.jobSlots != nil {
+				<-b.jobSlots
+			}
+			b.releaseCancelled(job)
+			return false
+		}
+	}
+	return true
 }
 
-func (b *Broker) executeJob(job bs.Job, shellCmd string) (result *JobResult, err error) {
-	result = &JobResult{JobId: job.Id, Executed: true}
-
-	ttr, err := job.TimeLeft()
-	timer := time.NewTimer(ttr + ttrMargin)
+// releaseCancelled releases a job unchanged, its handling having been
+// cancelled before it started.
+func (b *Broker) releaseCancelled(job bs.Job) {
+	pri, err := b.priority(job)
+	if err == nil {
+		err = job.ReleaseWithPriority(pri, 0)
+	}
 	if err != nil {
-		return
+		b.logf("releasing job %d on cancellation failed: %s", job.Id, err)
 	}
+}
 
-	cmd, out, err := cmd.NewCommand(shellCmd)
-	if err != nil {
-		return
+// releaseSlot frees the slots taken by acquireSlot.
+func (b *Broker) releaseSlot() {
+	if b.Limiter != nil {
+		b.Limiter.Release()
 	}
+	if b.jobSlots != nil {
+		<-b.jobSlots
+	}
+}
 
-	if err = cmd.StartWithStdin(job.Body); err != nil {
+// sendResult to RecentResults, ResultWriter, OnResult and the results
+// channel, if any, according to ResultsPolicy.
+func (b *Broker) sendResult(result *JobResult) {
+	b.recordRecent(result)
+	if b.OnResult != nil {
+		b.onResult(result)
+	}
+	if b.resultWriter != nil {
+		if ok, err := b.resultWriter.write(result); err != nil {
+			b.logf("encoding result for job %d failed: %s", result.JobId, err)
+		} else if !ok {
+			b.logf("result writer backlogged, dropped result for job %d", result.JobId)
+		}
+	}
+	if b.results == nil {
 		return
 	}
 
-	// TODO: end loop when stdout closes
-stdoutReader:
-	for {
+	switch b.ResultsPolicy {
+	case ResultsDrop:
 		select {
-		case <-timer.C:
-			if err = cmd.Terminate(); err != nil {
-				return
-			}
-			result.TimedOut = true
-		case data, ok := <-out:
-			if !ok {
-				break stdoutReader
-			}
-			b.log.Printf("stdout: %s", data)
-			result.Stdout = append(result.Stdout, data...)
+		case b.results <- result:
+			return
+		default:
 		}
-	}
+	case ResultsTimeoutDrop:
+		select {
+		case b.results <- result:
+			return
+		case <-b.clock().After(b.ResultsTimeout):
+		}
+	default:
+		b.results <- result
+		return
+	}
+
+	b.shared.droppedResults.Add(1)
+	b.logf("dropped result for job %d", result.JobId)
+}
+
+// ignoreCancel returns nil in place of err if ctx has been cancelled.
+func ignoreCancel(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// connect dials beanstalkd and watches the tube, retrying failed dials with
+// exponential backoff up to ReconnectTries times.
+func (b *Broker) connect(ctx context.Context) error {
+	var delay time.Duration
+	lastClass := DialErrorClass(-1)
+	maxDelay := b.ReconnectMaxDelay
+	if maxDelay == 0 {
+		maxDelay = DefaultReconnectMaxDelay
+	}
+
+	for try := 1; ; try++ {
+		b.logEvent(logFields{"event": "connect", "address": b.Address}, "connecting to %s", b.Address)
+		conn, err := b.dialConn()
+		if err == nil {
+			b.conn = conn
+			b.shared.connected.Add(1)
+			b.shared.lastContact.Store(b.clock().Now().UnixNano())
+			b.logf("watching %v", b.tubes())
+			// TubeSet watches exactly its tubes when reserving, ignoring
+			// "default" unless it is one of them, so jobs meant for another
+			// consumer of "default" aren't taken.
+			if raw, ok := bs.BeanstalkConn(conn); ok && b.NewReserver != nil {
+				b.ts = b.NewReserver(raw, b.tubes()...)
+			} else {
+				b.ts = conn.NewReserver(b.tubes()...)
+			}
+			return nil
+		}
+
+		if b.ReconnectTries > 0 && try >= b.ReconnectTries {
+			return fmt.Errorf("%w: connecting to %s failed after %d tries: %w", ErrDial, b.Address, try, err)
+		}
+
+		b.setLastError(err)
+		if class := classifyDialError(err); class != lastClass {
+			delay, lastClass = b.reconnectDelay(class), class
+		}
+		wait := b.jitter(delay)
+		b.logf("connect failed (%s): %s (retrying in %v)", lastClass, err, wait)
+		select {
+		case <-b.clock().After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// dialConn makes a new connection with Dial, or else by dialling Address.
+func (b *Broker) dialConn() (bs.Conn, error) {
+	if b.Dial != nil {
+		return b.Dial()
+	}
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	return bs.NewConn(conn), nil
+}
+
+// dial a new connection to beanstalkd, using TLS if TLSConfig is set, and
+// pass it to ConnectHook.
+func (b *Broker) dial() (conn *beanstalk.Conn, err error) {
+	if b.TLSConfig == nil {
+		conn, err = beanstalk.Dial("tcp", b.Address)
+	} else {
+		var tlsConn *tls.Conn
+		if tlsConn, err = tls.Dial("tcp", b.Address, b.TLSConfig); err == nil {
+			conn = beanstalk.NewConn(tlsConn)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if b.ConnectHook != nil {
+		if err = b.ConnectHook(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("connect hook: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// tubes returns Tubes, or Tube if Tubes is empty.
+func (b *Broker) tubes() []string {
+	if len(b.Tubes) > 0 {
+		return b.Tubes
+	}
+	return []string{b.Tube}
+}
+
+// reconnect closes the current connection and connects again.
+func (b *Broker) reconnect(ctx context.Context) error {
+	b.disconnect()
+	return b.connect(ctx)
+}
+
+// disconnect closes the current connection, if any, once deletes queued
+// on it have finished. Closing it returns any prefetched jobs to ready.
+func (b *Broker) disconnect() {
+	b.flushDeletes()
+	b.prefetched = nil
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+		b.shared.connected.Add(-1)
+	}
+}
+
+// reserve blocks until a job is reserved or ctx is cancelled, waking every
+// ReserveTimeout. A lost connection is re-established before reserving again.
+func (b *Broker) reserve(ctx context.Context) (id uint64, body []byte, err error) {
+	timeout := b.ReserveTimeout
+	if b.reserveTimeout > 0 {
+		timeout = b.reserveTimeout
+	} else if timeout == 0 {
+		timeout = b.defaultReserveTimeout()
+	}
+	if b.HeartbeatInterval > 0 {
+		timeout = min(timeout, b.HeartbeatInterval)
+	}
+	if b.SleepWhilePaused {
+		timeout = min(timeout, PauseCheckInterval)
+	}
+	lastBeat := b.clock().Now()
+	for {
+		if err = b.waitWhilePaused(ctx); err != nil {
+			return
+		}
+		// DEADLINE_SOON comes back as !ok. This connection holds no job
+		// while reserving, so there is nothing to touch, and Drain may
+		// close it to cut the wait short.
+		done, ok := b.reserving()
+		if !ok {
+			return 0, nil, ctx.Err()
+		}
+		id, body, ok, err := b.reserveOnce(ctx, timeout)
+		if done() && ok {
+			// The job was reserved just as Drain closed the connection,
+			// which returns it to ready, so it mustn't be executed.
+			b.logf("job %d reserved while draining, left to beanstalkd", id)
+			return 0, nil, ctx.Err()
+		}
+		if err != nil && ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+		if err != nil {
+			b.setLastError(err)
+			if !bs.ConnectionLost(err) {
+				return 0, nil, fmt.Errorf("%w: %w", ErrReserve, err)
+			}
+			b.logf("reserve failed: %s", err)
+			if err = b.reconnect(ctx); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		b.shared.lastContact.Store(b.clock().Now().UnixNano())
+		if ok {
+			return id, body, nil
+		}
+		b.checkPaused(ctx)
+		b.heartbeat(&lastBeat)
+	}
+}
+
+// heartbeat logs that the broker is idle if HeartbeatInterval has passed
+// since lastBeat.
+func (b *Broker) heartbeat(lastBeat *time.Time) {
+	if b.HeartbeatInterval <= 0 {
+		return
+	}
+	if now := b.clock().Now(); now.Sub(*lastBeat) >= b.HeartbeatInterval {
+		b.logEvent(logFields{"event": "heartbeat"}, "idle, watching %s", strings.Join(b.tubes(), ","))
+		*lastBeat = now
+	}
+}
+
+// reserveOnce reserves with timeout or, with PollIdle, polls the tubes and
+// reserves without waiting once one has a ready job.
+func (b *Broker) reserveOnce(ctx context.Context, timeout time.Duration) (id uint64, body []byte, ok bool, err error) {
+	if !b.PollIdle {
+		return bs.ReserveWithTimeoutSleep(b.ts, timeout, b.clock().Sleep)
+	}
+	ready, delayed, err := b.anyReady()
+	if err != nil {
+		return
+	}
+	if ready {
+		return bs.ReserveWithTimeoutSleep(b.ts, 0, b.clock().Sleep)
+	}
+
+	interval := b.PollInterval
+	if interval == 0 {
+		interval = DefaultPollInterval
+	}
+	if b.PollDelayed {
+		interval = b.pollDelayedInterval(interval, delayed)
+	}
+	select {
+	case <-b.clock().After(interval):
+	case <-ctx.Done():
+	}
+	return
+}
+
+// anyReady reports whether stats-tube shows a ready job in any tube, and if
+// not, which tubes have delayed jobs. A tube which doesn't exist yet has
+// none.
+func (b *Broker) anyReady() (ready bool, delayed []string, err error) {
+	for _, name := range b.tubes() {
+		stats, err := b.conn.StatsTube(name)
+		if bs.NotFound(err) {
+			continue
+		}
+		if err != nil {
+			return false, nil, err
+		}
+		if parseCount(stats["current-jobs-ready"]) > 0 {
+			return true, nil, nil
+		}
+		if parseCount(stats["current-jobs-delayed"]) > 0 {
+			delayed = append(delayed, name)
+		}
+	}
+	return false, delayed, nil
+}
+
+// pollDelayedInterval is how long PollIdle should sleep, given the tubes
+// with delayed jobs: until the soonest is due, bounded by PollMinInterval
+// and PollMaxInterval, or PollMaxInterval if none can be estimated.
+func (b *Broker) pollDelayedInterval(interval time.Duration, delayed []string) time.Duration {
+	minInterval, maxInterval := b.PollMinInterval, b.PollMaxInterval
+	if minInterval == 0 {
+		minInterval = DefaultPollMinInterval
+	}
+	if maxInterval == 0 {
+		maxInterval = interval
+	}
+
+	next := maxInterval
+	for _, name := range delayed {
+		id, _, err := b.conn.PeekDelayed(name)
+		if err != nil {
+			continue // most likely became ready, or was deleted
+		}
+		// time-left of a delayed job is its remaining delay.
+		left, err := bs.NewJob(id, nil, b.conn).TimeLeft()
+		if err != nil {
+			continue
+		}
+		if left < next {
+			next = left
+		}
+	}
+	return min(max(next, minInterval), maxInterval)
+}
+
+// ttrReserveTimeout returns the largest TTR of the next ready job in each
+// tube, multiplied by ReserveTimeoutTTRFactor. Zero if none could be read.
+func (b *Broker) ttrReserveTimeout() time.Duration {
+	var ttr time.Duration
+	for _, name := range b.tubes() {
+		id, _, err := b.conn.PeekReady(name)
+		if err != nil {
+			continue // most likely no ready job
+		}
+		t, err := bs.NewJob(id, nil, b.conn).TTR()
+		if err != nil {
+			b.logf("sampling TTR of job %d failed: %s", id, err)
+			continue
+		}
+		if t > ttr {
+			ttr = t
+		}
+	}
+	return time.Duration(float64(ttr) * b.ReserveTimeoutTTRFactor)
+}
+
+// processJob buries a job which has exhausted its tries, otherwise executes
+// it and deletes, releases or buries it according to the result.
+// Returned errors are from beanstalkd or from starting the command.
+// Hooks are given ctx carrying the job's JobInfo.
+func (b *Broker) processJob(ctx context.Context, job bs.Job) (result *JobResult, err error) {
+	info, err := newJobInfo(job)
+	if err != nil {
+		return
+	}
+	tube := info.Tube
+
+	// The job is seen through even if Run is cancelled meanwhile.
+	ctx = withJobInfo(context.WithoutCancel(ctx), &info)
+	b.emit(ctx, PhaseReserve, &JobResult{JobId: job.Id, Tube: tube})
+
+	// Everything needed from stats-job is read from the one call above.
+	t := parseCount(info.Stats["timeouts"])
+	releases := parseCount(info.Stats["releases"])
+	reserves := parseCount(info.Stats["reserves"])
+	age := time.Duration(parseCount(info.Stats["age"])) * time.Second
+	defer func() {
+		if result != nil {
+			result.Reserves, result.Releases, result.Timeouts, result.Age = reserves, releases, t, age
+			if b.IncludeJobStats {
+				result.Stats = info.Stats
+			}
+		}
+	}()
+
+	if t >= TimeoutTries {
+		b.logf("job %d has %d timeouts, giving up", job.Id, t)
+		return b.giveUp(ctx, job, tube, t)
+	}
+	if releases >= b.maxReleases() {
+		b.logf("job %d has %d releases, giving up", job.Id, releases)
+		return b.giveUp(ctx, job, tube, releases)
+	}
+	if total := reserves + t + releases; b.PoisonThreshold > 0 && total > uint64(b.PoisonThreshold) {
+		b.logf("job %d looks poisoned, giving up: %d reserves, %d timeouts and %d releases exceed PoisonThreshold %d",
+			job.Id, reserves, t, releases, b.PoisonThreshold)
+		return b.giveUp(ctx, job, tube, total)
+	}
+
+	if b.MaxBodyBytes > 0 && len(job.Body) > b.MaxBodyBytes {
+		b.logf("job %d body of %d bytes exceeds MaxBodyBytes %d, rejecting", job.Id, len(job.Body), b.MaxBodyBytes)
+		b.shared.rejected.Add(1)
+		result, err = b.giveUp(ctx, job, tube, releases)
+		result.Rejected = true
+		return
+	}
+
+	stdin := job.Body
+	var buildErr error
+	if b.Transform != nil {
+		inHook("Transform", func() { stdin, buildErr = b.Transform(job.Body) })
+	}
+	if buildErr == nil && b.StdinBuilder != nil && b.BatchSplit == nil {
+		inHook("StdinBuilder", func() { stdin, buildErr = b.StdinBuilder(info, stdin) })
+	}
+	if buildErr != nil {
+		b.logf("transforming job %d failed: %s", job.Id, buildErr)
+		result = &JobResult{JobId: job.Id, Tube: tube, Error: buildErr}
+		action := Release
+		if b.BuryOnTransformError {
+			action = Bury
+		}
+		err = b.perform(ctx, job, action, result)
+		return
+	}
+
+	b.logEvent(logFields{"event": "execute", "job_id": job.Id, "job_tube": tube}, "executing job %d from %s", job.Id, tube)
+	b.emit(ctx, PhaseStart, &JobResult{JobId: job.Id, Tube: tube})
+	shellCmd, ok := b.CmdByTube[tube]
+	if !ok {
+		shellCmd = b.Cmd
+	}
+	if b.cmdTemplate != nil && !ok {
+		var renderErr error
+		if shellCmd, renderErr = renderCmd(b.cmdTemplate, info); renderErr != nil {
+			b.logf("rendering CmdTemplate for job %d failed: %s", job.Id, renderErr)
+			result = &JobResult{JobId: job.Id, Tube: tube, Error: renderErr}
+			err = b.perform(ctx, job, Release, result)
+			return
+		}
+	}
+
+	if b.BatchSplit != nil {
+		result, err = b.executeBatch(job, &info, stdin, shellCmd)
+	} else {
+		result, err = b.execute(job, &info, stdin, shellCmd)
+	}
+	b.metrics().ObserveDuration(result.Duration)
+	result.Tube = tube
+	if err != nil {
+		return
+	}
+	b.emit(ctx, PhaseFinish, result)
+	b.checkSlow(ctx, result)
+
+	err = b.handleResult(ctx, job, result)
+	return
+}
+
+// giveUp on a job which has exhausted its tries, moving it to DeadLetterTube
+// if set, otherwise burying it.
+func (b *Broker) giveUp(ctx context.Context, job bs.Job, tube string, failures uint64) (result *JobResult, err error) {
+	result = &JobResult{JobId: job.Id, Tube: tube}
+	if b.DeadLetterTube == "" || b.DryRun {
+		err = b.perform(ctx, job, Bury, result)
+		return
+	}
+	result.DeadLettered = true
+	if err = b.deadLetter(job, tube, failures); err == nil {
+		b.emit(ctx, PhaseDelete, result)
+	} else if b.jobLost(job, Delete, err) {
+		err = nil
+	}
+	return
+}
+
+// deadLetter puts the job's body into DeadLetterTube, with its original
+// priority and TTR, then deletes the job.
+func (b *Broker) deadLetter(job bs.Job, tube string, failures uint64) error {
+	pri, err := b.priority(job)
+	if err != nil {
+		return err
+	}
+	ttr, err := job.TTR()
+	if err != nil {
+		return err
+	}
+
+	transform := b.DeadLetterTransform
+	if transform == nil {
+		transform = DefaultDeadLetterTransform
+	}
+
+	var body []byte
+	inHook("DeadLetterTransform", func() { body = transform(tube, failures, job.Body) })
+	id, err := b.conn.Put(b.DeadLetterTube, body, pri, 0, ttr)
+	if err != nil {
+		return err
+	}
+	b.logEvent(logFields{"event": "action", "action": "dead-letter", "job_id": job.Id},
+		"moved job %d to %s as job %d, deleting", job.Id, b.DeadLetterTube, id)
+	return b.retry(job, Delete, job.Delete)
+}
+
+// DefaultDeadLetterTransform prepends a header line naming the original tube
+// and failure count to the body, e.g. "tube=emails failures=10\n".
+func DefaultDeadLetterTransform(tube string, failures uint64, body []byte) []byte {
+	header := fmt.Sprintf("tube=%s failures=%d\n", tube, failures)
+	return append([]byte(header), body...)
+}
+
+func (b *Broker) executeJob(job bs.Job, info *JobInfo, stdin []byte, shellCmd string) (result *JobResult, err error) {
+	result = &JobResult{JobId: job.Id, Executed: true}
+
+	var ttrTimeout, touch <-chan time.Time
+	var touchInterval time.Duration
+	if b.KeepAlive {
+		touchInterval = b.TouchInterval
+		if touchInterval == 0 {
+			var ttr time.Duration
+			if ttr, err = job.TTR(); err != nil {
+				return
+			}
+			touchInterval = ttr / 2
+		}
+		touch = b.clock().After(touchInterval)
+	} else {
+		var ttr time.Duration
+		if ttr, err = job.TimeLeft(); err != nil {
+			return
+		}
+		ttrTimeout = b.clock().After(ttr + ttrMargin)
+	}
+
+	newCommand := cmd.NewArgvCommand
+	if b.CaptureStdout != nil && !*b.CaptureStdout {
+		newCommand = cmd.NewArgvCommandDiscardStdout
+	}
+	cmd, out, errOut, err := newCommand(b.argv(shellCmd))
+	if err != nil {
+		return
+	}
+
+	if b.BodyVia == BodyViaTempFile {
+		var path string
+		if path, err = writeTempFile(stdin); err != nil {
+			return
+		}
+		defer os.Remove(path)
+		cmd.AddEnv("BEANSTALK_JOB_FILE=" + path)
+		stdin = nil
+	}
+
+	if b.WorkDir != "" {
+		cmd.SetDir(b.WorkDir)
+	}
+	cmd.AddEnv(b.Env...)
+
+	if !b.DisableJobEnv {
+		cmd.AddEnv(jobEnv(info)...)
+	}
+
+	result.StartedAt = b.clock().Now()
+	defer func() {
+		result.Duration = b.clock().Now().Sub(result.StartedAt)
+	}()
+
+	var budgeted int
+	defer func() {
+		b.shared.stdoutBytes.Add(-int64(budgeted))
+	}()
+
+	if len(stdin) == 0 && b.NullStdinOnEmpty {
+		err = cmd.StartWithNullStdin()
+	} else {
+		err = cmd.StartWithStdin(stdin)
+	}
+	if err != nil {
+		if notFound(err) {
+			result.CommandNotFound = true
+			result.ExitStatus = ExitCommandNotFound
+			result.Error = err
+		} else {
+			result.ExitStatus = -1
+			result.Err = fmt.Errorf("%w: %w", ErrCommandStart, err)
+		}
+		return result, nil
+	}
+
+	var jobTimeout, killGrace <-chan time.Time
+	if b.JobTimeout > 0 {
+		jobTimeout = b.clock().After(b.JobTimeout)
+	}
+	var killed bool // by SIGKILL after KillGrace
+
+	cancelled := b.register(job.Id)
+	defer b.unregister(job.Id)
+
+	var stdinErr error
+	stdinDone := cmd.StdinDone()
+	var stdinTimeout <-chan time.Time
+	if b.StdinWriteTimeout > 0 {
+		stdinTimeout = b.clock().After(b.StdinWriteTimeout)
+	}
+
+	var stdoutTimeout <-chan time.Time
+	if b.StdoutReadTimeout > 0 && out != nil {
+		stdoutTimeout = b.clock().After(b.StdoutReadTimeout)
+	}
+
+	// Both streams are drained concurrently; a nil channel blocks forever,
+	// so each is disabled in the select once it closes.
+	for out != nil || errOut != nil {
+		select {
+		case <-ttrTimeout:
+			if err = cmd.Terminate(); err != nil {
+				return
+			}
+			result.TimedOut = true
+		case <-touch:
+			b.touch(job)
+			touch = b.clock().After(touchInterval)
+		case <-jobTimeout:
+			if killGrace, err = b.stop(cmd, job); err != nil {
+				return
+			}
+			result.JobTimedOut = true
+		case <-killGrace:
+			b.logf("job %d still running after %v, killing", job.Id, b.KillGrace)
+			if err = cmd.Kill(); err != nil {
+				return
+			}
+			killGrace, killed = nil, true
+		case <-cancelled:
+			b.logf("job %d cancelled, killing", job.Id)
+			if err = cmd.Kill(); err != nil {
+				return
+			}
+			result.Cancelled = true
+			cancelled = nil
+		case stdinErr = <-stdinDone:
+			stdinDone, stdinTimeout = nil, nil
+		case <-stdinTimeout:
+			b.logf("job %d stdin not consumed within %v, killing", job.Id, b.StdinWriteTimeout)
+			if err = cmd.Kill(); err != nil {
+				return
+			}
+			result.StalledIO = true
+			stdinTimeout = nil
+		case <-stdoutTimeout:
+			b.logf("job %d stdout idle for %v, killing", job.Id, b.StdoutReadTimeout)
+			if err = cmd.Kill(); err != nil {
+				return
+			}
+			result.StalledIO = true
+			stdoutTimeout = nil
+		case data, ok := <-out:
+			if !ok {
+				out, stdoutTimeout = nil, nil
+				continue
+			}
+			if stdoutTimeout != nil {
+				stdoutTimeout = b.clock().After(b.StdoutReadTimeout)
+			}
+			b.logf("stdout: %s", data)
+			if b.StdoutWriter != nil {
+				if _, err := b.StdoutWriter.Write(data); err != nil {
+					b.logf("writing stdout failed: %s", err)
+				}
+			}
+			n := len(result.Stdout)
+			stdout := b.appendStdout(result.Stdout, data)
+			added := b.takeStdoutBudget(len(stdout) - n)
+			result.Stdout = stdout[:n+added]
+			budgeted += added
+		case data, ok := <-errOut:
+			if !ok {
+				errOut = nil
+				continue
+			}
+			result.Stderr += string(data)
+		}
+	}
 
 	waitC := cmd.WaitChan()
 
@@ -196,41 +1797,590 @@ waitLoop:
 	for {
 		select {
 		case wr := <-waitC:
-			timer.Stop()
-			if wr.Err == nil {
-				err = wr.Err
+			if wr.Err != nil {
+				result.Err = fmt.Errorf("waiting for command: %w", wr.Err)
 			}
 			result.ExitStatus = wr.Status
+			result.Signaled, result.Signal = wr.Signal != 0, wr.Signal
+			result.GracefulStop = result.JobTimedOut && b.KillGrace > 0 && !killed
 			break waitLoop
-		case <-timer.C:
+		case <-ttrTimeout:
 			cmd.Terminate()
 			result.TimedOut = true
+		case <-touch:
+			b.touch(job)
+			touch = b.clock().After(touchInterval)
+		case <-jobTimeout:
+			killGrace, _ = b.stop(cmd, job)
+			result.JobTimedOut = true
+		case <-killGrace:
+			b.logf("job %d still running after %v, killing", job.Id, b.KillGrace)
+			cmd.Kill()
+			killGrace, killed = nil, true
+		case <-cancelled:
+			cmd.Kill()
+			result.Cancelled = true
+			cancelled = nil
+		}
+	}
+
+	// The write fails with EPIPE if the command exits without consuming
+	// all of stdin; that is reported on the result rather than failing Run.
+	if stdinDone != nil {
+		stdinErr = <-stdinDone
+	}
+	if stdinErr != nil && result.Error == nil {
+		result.Error = fmt.Errorf("writing stdin: %w", stdinErr)
+	}
+
+	return
+}
+
+// stop the command for exceeding JobTimeout: with KillSignal if KillGrace is
+// set, returning a channel which fires when the grace period is up, otherwise
+// with SIGKILL.
+func (b *Broker) stop(c *cmd.Cmd, job bs.Job) (<-chan time.Time, error) {
+	if b.KillGrace <= 0 {
+		return nil, c.Kill()
+	}
+	sig := b.KillSignal
+	if sig == 0 {
+		sig = syscall.SIGTERM
+	}
+	b.logf("job %d exceeded job timeout, sending %s", job.Id, sig)
+	return b.clock().After(b.KillGrace), c.Signal(sig)
+}
+
+// notFound reports whether err from starting a command means the program
+// doesn't exist or can't be executed, rather than a system failure.
+func notFound(err error) bool {
+	var execErr *exec.Error
+	if errors.As(err, &execErr) {
+		return true
+	}
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) ||
+		errors.Is(err, syscall.ENOEXEC) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// appendStdout appends data to stdout, up to MaxStdoutBytes.
+func (b *Broker) appendStdout(stdout, data []byte) []byte {
+	if b.MaxStdoutBytes <= 0 {
+		return append(stdout, data...)
+	}
+	room := b.MaxStdoutBytes - len(stdout)
+	if room < 0 {
+		return stdout // already truncated
+	}
+	if len(data) > room {
+		stdout = append(stdout, data[:room]...)
+		return append(stdout, TruncatedMarker...)
+	}
+	return append(stdout, data...)
+}
+
+// takeStdoutBudget takes up to n bytes from MaxTotalStdoutBytes, returning
+// how many may be buffered. The rest are counted as discarded.
+func (b *Broker) takeStdoutBudget(n int) int {
+	if b.MaxTotalStdoutBytes <= 0 || n == 0 {
+		return n
+	}
+	for {
+		used := b.shared.stdoutBytes.Load()
+		take := int64(n)
+		if room := int64(b.MaxTotalStdoutBytes) - used; take > room {
+			take = room
+		}
+		if take < 0 {
+			take = 0
+		}
+		if b.shared.stdoutBytes.CompareAndSwap(used, used+take) {
+			b.shared.discardedStdout.Add(uint64(int64(n) - take))
+			return int(take)
 		}
 	}
+}
 
+// touch the job to keep it reserved; failures are logged, as a lost
+// connection will be detected when the job finishes.
+func (b *Broker) touch(job bs.Job) {
+	if err := job.Touch(); err != nil {
+		b.logf("touching job %d failed: %s", job.Id, err)
+	}
+}
+
+// writeTempFile writes data to a new temporary file, returning its path.
+func writeTempFile(data []byte) (path string, err error) {
+	f, err := os.CreateTemp("", "cmdstalk-job-")
+	if err != nil {
+		return
+	}
+	path = f.Name()
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(path)
+	}
 	return
 }
 
-func (b *Broker) handleResult(job bs.Job, result *JobResult) (err error) {
+// jobEnv returns BEANSTALK_* environment variables describing the job.
+func jobEnv(info *JobInfo) []string {
+	return []string{
+		fmt.Sprintf("BEANSTALK_JOB_ID=%d", info.Id),
+		"BEANSTALK_TUBE=" + info.Tube,
+		"BEANSTALK_PRIORITY=" + info.Stats["pri"],
+		"BEANSTALK_RELEASES=" + info.Stats["releases"],
+		"BEANSTALK_TIMEOUTS=" + info.Stats["timeouts"],
+	}
+}
+
+// argv returns the command and arguments to execute shellCmd, or Command if
+// it is set, wrapped to apply any resource limits.
+func (b *Broker) argv(shellCmd string) []string {
+	return b.withLimits(b.commandArgv(shellCmd))
+}
+
+func (b *Broker) commandArgv(shellCmd string) []string {
+	if len(b.Command) > 0 {
+		return b.Command
+	}
+	if b.ShellDisabled {
+		return strings.Fields(shellCmd)
+	}
+	shell := b.Shell
+	if len(shell) == 0 {
+		path := b.ShellPath
+		if path == "" {
+			path = cmd.Shell
+		}
+		args := b.ShellArgs
+		if len(args) == 0 {
+			args = []string{"-c"}
+		}
+		shell = append([]string{path}, args...)
+	}
+	argv := make([]string, 0, len(shell)+1)
+	return append(append(argv, shell...), shellCmd)
+}
+
+// usesDefaultShell reports whether argv runs Cmd with ShellPath.
+func (b *Broker) usesDefaultShell() bool {
+	return len(b.Command) == 0 && !b.ShellDisabled && len(b.Shell) == 0
+}
+
+// lookupShell finds bash on PATH, falling back to cmd.Shell if it exists.
+func lookupShell() (string, error) {
+	path, err := exec.LookPath("bash")
+	if err == nil {
+		return path, nil
+	}
+	if _, statErr := os.Stat(cmd.Shell); statErr == nil {
+		return cmd.Shell, nil
+	}
+	return "", fmt.Errorf("no shell found: %w", err)
+}
+
+func (b *Broker) handleResult(ctx context.Context, job bs.Job, result *JobResult) (err error) {
 	if result.TimedOut {
-		b.log.Printf("job %d timed out", job.Id)
+		b.logEvent(finishFields(result), "job %d timed out", job.Id)
 		return
 	}
-	b.log.Printf("job %d finished with exit(%d)", job.Id, result.ExitStatus)
-	switch result.ExitStatus {
-	case 0:
-		b.log.Printf("deleting job %d", job.Id)
-		err = job.Delete()
-	default:
-		r, err := job.Releases()
+	if result.BatchCompleted < result.BatchRecords {
+		b.logEvent(finishFields(result), "job %d failed at record %d of %d with exit(%d)",
+			job.Id, result.BatchCompleted+1, result.BatchRecords, result.ExitStatus)
+		return b.perform(ctx, job, Release, result)
+	}
+	if result.JobTimedOut {
+		b.logEvent(finishFields(result), "job %d exceeded job timeout %v", job.Id, b.JobTimeout)
+		return b.perform(ctx, job, Release, result)
+	}
+	if result.Cancelled {
+		b.logEvent(finishFields(result), "job %d cancelled", job.Id)
+		return b.perform(ctx, job, Release, result)
+	}
+	if result.StalledIO {
+		b.logEvent(finishFields(result), "job %d stalled on stdin or stdout", job.Id)
+		return b.perform(ctx, job, Release, result)
+	}
+	if result.CommandNotFound {
+		b.logEvent(finishFields(result), "job %d command not found: %s", job.Id, result.Error)
+		action := b.CommandNotFoundAction
+		if action == NoAction {
+			action = Bury
+		}
+		return b.perform(ctx, job, action, result)
+	}
+	if result.Err != nil {
+		b.setLastError(result.Err)
+		b.logEvent(finishFields(result), "job %d failed to execute: %s", job.Id, result.Err)
+		return b.perform(ctx, job, Release, result)
+	}
+	if result.Signaled {
+		b.logEvent(finishFields(result), "job %d killed by %s", job.Id, result.Signal)
+		if b.SignaledAction != NoAction {
+			return b.perform(ctx, job, b.SignaledAction, result)
+		}
+	} else {
+		b.logEvent(finishFields(result), "job %d finished with exit(%d)", job.Id, result.ExitStatus)
+	}
+
+	if b.RetryAfterExitStatus != 0 && result.ExitStatus == b.RetryAfterExitStatus {
+		if delay, ok := retryAfter(result.Stdout); ok {
+			result.RetryAfter = delay
+		} else {
+			b.logf("job %d exit(%d) without a valid %q line, releasing as usual", job.Id, result.ExitStatus, RetryAfterPrefix)
+		}
+		return b.perform(ctx, job, Release, result)
+	}
+
+	actionFor := b.ActionFor
+	if actionFor == nil {
+		actionFor = DefaultActionFor
+	}
+	var action Action
+	inHook("ActionFor", func() { action = actionFor(result.ExitStatus) })
+	if b.SuccessValidator != nil && result.ExitStatus == 0 && !result.Signaled {
+		var override Action
+		inHook("SuccessValidator", func() { override = b.SuccessValidator(result) })
+		if override != NoAction && override != action {
+			b.logf("job %d exit(0) judged by SuccessValidator: %s rather than %s", job.Id, override, action)
+			action = override
+		}
+	}
+
+	if b.PipelineTube != "" && action == Delete && result.ExitStatus == 0 && !b.DryRun {
+		if err = b.pipeline(job, result); err != nil {
+			if bs.ConnectionLost(err) {
+				return err
+			}
+			b.logf("putting job %d stdout into %s failed, releasing: %s", job.Id, b.PipelineTube, err)
+			action = Release
+		}
+	}
+	return b.perform(ctx, job, action, result)
+}
+
+// pipeline puts the job's stdout into PipelineTube, recording the new job's
+// id in result.
+func (b *Broker) pipeline(job bs.Job, result *JobResult) error {
+	pri := b.PipelinePriority
+	if pri == nil {
+		p, err := b.priority(job)
 		if err != nil {
-			r = ReleaseTries
+			return err
+		}
+		pri = &p
+	}
+	ttr := b.PipelineTTR
+	if ttr == 0 {
+		var err error
+		if ttr, err = job.TTR(); err != nil {
+			return err
 		}
-		// r*r*r*r means final of 10 tries has 1h49m21s delay, 4h15m33s total.
-		// See: http://play.golang.org/p/I15lUWoabI
-		delay := time.Duration(r*r*r*r) * time.Second
-		b.log.Printf("releasing job %d with %v delay (%d retries)", job.Id, delay, r)
-		err = job.Release(delay)
+	}
+
+	id, err := b.conn.Put(b.PipelineTube, result.Stdout, *pri, b.PipelineDelay, ttr)
+	if err != nil {
+		return err
+	}
+	result.PipelineJobId = id
+	b.logEvent(logFields{"event": "action", "action": "pipeline", "job_id": job.Id},
+		"put job %d stdout into %s as job %d", job.Id, b.PipelineTube, id)
+	return nil
+}
+
+// perform the action on the job, recording it in result.
+// In DryRun mode the job is released unchanged instead.
+//
+// If the connection the job was reserved on has been lost, e.g. while its
+// command ran, beanstalkd has returned the job to ready. The broker
+// reconnects and performs the action on the new connection, so that a
+// delete still stops the job being handled again, unless another worker
+// has reserved it meanwhile. A release is already done, less its delay and
+// priority, and a bury can't be, leaving the job ready.
+func (b *Broker) perform(ctx context.Context, job bs.Job, action Action, result *JobResult) (err error) {
+	defer func() {
+		if b.jobLost(job, action, err) {
+			err = nil
+		}
+	}()
+
+	err = b.performOnce(ctx, job, action, result)
+	if !bs.ConnectionLost(err) {
+		return
+	}
+	b.logf("connection lost before %s of job %d, reconnecting: %s", action, job.Id, err)
+	b.setLastError(err)
+	if err = b.reconnect(ctx); err != nil {
+		return
+	}
+	job = bs.NewJob(job.Id, job.Body, b.conn)
+	err = b.performOnce(ctx, job, action, result)
+	if bs.NotFound(err) && result.IntendedAction == Release {
+		b.logEvent(actionFields(job, Release), "job %d was returned to ready by its connection closing", job.Id)
+		b.emit(ctx, PhaseRelease, result)
+		return nil
 	}
 	return
 }
+
+// performOnce performs the action on the connection the job holds.
+func (b *Broker) performOnce(ctx context.Context, job bs.Job, action Action, result *JobResult) (err error) {
+	result.IntendedAction = action
+	if b.DryRun {
+		pri, err := b.priority(job)
+		if err != nil {
+			return err
+		}
+		b.logEvent(actionFields(job, Release), "dry run: releasing job %d instead of %s", job.Id, action)
+		err = b.retry(job, Release, func() error {
+			return job.ReleaseWithPriority(pri, 0)
+		})
+		if err == nil {
+			b.emit(ctx, PhaseRelease, result)
+		}
+		return err
+	}
+
+	switch action {
+	case Delete:
+		if b.deleter != nil {
+			b.queueDelete(ctx, job, result)
+			return
+		}
+		b.logEvent(actionFields(job, Delete), "deleting job %d", job.Id)
+		if err = b.retry(job, Delete, job.Delete); err == nil {
+			b.metrics().IncrDeleted()
+		}
+	case Release:
+		err = b.release(ctx, job, result.RetryAfter)
+	case Bury:
+		if result.Executed {
+			b.logEvent(actionFields(job, Bury), "burying job %d after exit(%d)", job.Id, result.ExitStatus)
+		} else {
+			b.logEvent(actionFields(job, Bury), "burying job %d", job.Id)
+		}
+		err = b.bury(job)
+		result.Buried = true
+	default:
+		err = fmt.Errorf("unknown action %v for job %d", action, job.Id)
+	}
+	if err == nil {
+		b.emit(ctx, actionPhases[action], result)
+	}
+	return
+}
+
+// actionPhases maps each terminal Action to the Phase it emits.
+var actionPhases = map[Action]Phase{
+	Delete:  PhaseDelete,
+	Release: PhaseRelease,
+	Bury:    PhaseBury,
+}
+
+// retryAfter parses the delay from the last RetryAfterPrefix line of
+// stdout, as a duration or whole seconds.
+func retryAfter(stdout []byte) (delay time.Duration, ok bool) {
+	for _, line := range strings.Split(string(stdout), "\n") {
+		value, found := strings.CutPrefix(strings.TrimSpace(line), RetryAfterPrefix)
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if secs, err := strconv.ParseUint(value, 10, 32); err == nil {
+			delay, ok = time.Duration(secs)*time.Second, true
+		} else if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			delay, ok = d, true
+		}
+	}
+	return
+}
+
+// release the job with an exponential-backoff delay based on its releases,
+// as read when it was reserved, or with delay if it is positive.
+func (b *Broker) release(ctx context.Context, job bs.Job, delay time.Duration) error {
+	var r uint64
+	if info, ok := JobInfoFromContext(ctx); ok {
+		r = parseCount(info.Stats["releases"])
+	} else if n, err := job.Releases(); err == nil {
+		r = n
+	} else {
+		r = b.maxReleases()
+	}
+	if delay <= 0 {
+		delay = b.releaseDelay(r)
+	}
+	pri, err := b.releasePriority(job)
+	if err != nil {
+		return err
+	}
+	b.logEvent(actionFields(job, Release), "releasing job %d with %v delay (%d retries)", job.Id, delay, r)
+	err = b.retry(job, Release, func() error {
+		return job.ReleaseWithPriority(pri, delay)
+	})
+	if err != nil {
+		return err
+	}
+	b.metrics().IncrReleased()
+	return nil
+}
+
+// releasePriority is ReleasePriority if set, otherwise the job's reserved
+// priority plus ReleasePriorityOffset, clamped to the uint32 range.
+func (b *Broker) releasePriority(job bs.Job) (uint32, error) {
+	if b.ReleasePriority != nil {
+		return *b.ReleasePriority, nil
+	}
+	pri, err := b.priority(job)
+	if err != nil || b.ReleasePriorityOffset == 0 {
+		return pri, err
+	}
+	p := int64(pri) + b.ReleasePriorityOffset
+	if p < 0 {
+		p = 0
+	} else if p > math.MaxUint32 {
+		p = math.MaxUint32
+	}
+	return uint32(p), nil
+}
+
+// bury the job with BuryPriority, or its reserved priority.
+func (b *Broker) bury(job bs.Job) (err error) {
+	var pri uint32
+	if b.BuryPriority != nil {
+		pri = *b.BuryPriority
+	} else if pri, err = b.priority(job); err != nil {
+		return err
+	}
+	err = b.retry(job, Bury, func() error {
+		return job.BuryWithPriority(pri)
+	})
+	if err != nil {
+		return err
+	}
+	b.metrics().IncrBuried()
+	return nil
+}
+
+// jobLost reports whether err from performing action on job is beanstalkd's
+// NOT_FOUND, which means the reservation was lost, usually to TTR expiring,
+// and beanstalkd has already made the job ready again. That is logged and
+// counted rather than treated as a failure.
+func (b *Broker) jobLost(job bs.Job, action Action, err error) bool {
+	if !bs.NotFound(err) {
+		return false
+	}
+	b.shared.lostJobs.Add(1)
+	b.logEvent(logFields{"event": "lost", "action": action.String(), "job_id": job.Id},
+		"warning: job %d not found to %s, its reservation was probably lost to TTR", job.Id, action)
+	return true
+}
+
+// actionError is a delete, release or bury which failed, after any retries.
+// Run reconnects rather than returning it. It is an ErrTerminalOp.
+type actionError struct {
+	action Action
+	jobId  uint64
+	err    error
+}
+
+func (e *actionError) Error() string {
+	return fmt.Sprintf("%s job %d: %s", e.action, e.jobId, e.err)
+}
+
+func (e *actionError) Unwrap() error { return e.err }
+
+func (e *actionError) Is(target error) bool { return target == ErrTerminalOp }
+
+// retry op, performing action on job, up to ActionRetries times while it
+// fails with a transient error.
+func (b *Broker) retry(job bs.Job, action Action, op func() error) error {
+	delay := b.ActionRetryDelay
+	if delay == 0 {
+		delay = DefaultActionRetryDelay
+	}
+	err := op()
+	for i := 0; err != nil && i < b.ActionRetries && bs.Transient(err); i++ {
+		b.logf("%s job %d failed, retrying in %v: %s", action, job.Id, delay, err)
+		b.clock().Sleep(delay)
+		delay *= 2
+		err = op()
+	}
+	if err != nil {
+		return &actionError{action: action, jobId: job.Id, err: err}
+	}
+	return nil
+}
+
+// priority of the job, or DefaultPriority if beanstalkd reported a
+// malformed value.
+func (b *Broker) priority(job bs.Job) (uint32, error) {
+	pri, err := job.Priority()
+	var numErr *strconv.NumError
+	if errors.As(err, &numErr) {
+		b.logf("%s, using priority %d", err, DefaultPriority)
+		return DefaultPriority, nil
+	}
+	return pri, err
+}
+
+func (b *Broker) metrics() Metrics {
+	if b.Metrics == nil {
+		return &b.shared.counters
+	}
+	return teeMetrics{&b.shared.counters, b.Metrics}
+}
+
+// setLastError records err to be reported by Stats.
+func (b *Broker) setLastError(err error) {
+	b.shared.mu.Lock()
+	defer b.shared.mu.Unlock()
+	b.shared.lastErr = err
+}
+
+// releaseDelay for a job which has been released r times.
+func (b *Broker) releaseDelay(r uint64) time.Duration {
+	base := b.ReleaseBackoff
+	if base == 0 {
+		base = 1 * time.Second
+	}
+	// r*r*r*r means final of 10 tries has 1h49m21s delay, 4h15m33s total.
+	// See: http://play.golang.org/p/I15lUWoabI
+	delay := time.Duration(r*r*r*r) * base
+	if b.ReleaseBackoffMax > 0 && delay > b.ReleaseBackoffMax {
+		delay = b.ReleaseBackoffMax
+	}
+	delay = b.jitter(delay)
+	if delay < b.ReleaseDelay {
+		delay = b.ReleaseDelay
+	}
+	return delay
+}
+
+// jitter shortens d by a random fraction of up to Jitter.
+func (b *Broker) jitter(d time.Duration) time.Duration {
+	if b.Jitter <= 0 || d <= 0 {
+		return d
+	}
+	if b.rng == nil {
+		b.rng = b.newRand()
+	}
+	return d - time.Duration(b.rng.Float64()*min(b.Jitter, 1)*float64(d))
+}
+
+// newRand returns a random source seeded differently for each broker and
+// worker, so that their jitter isn't correlated.
+func (b *Broker) newRand() *rand.Rand {
+	seed := time.Now().UnixNano() ^ int64(b.slot)<<32 ^ int64(b.shared.seeds.Add(1))
+	return rand.New(rand.NewSource(seed))
+}
+
+func (b *Broker) maxReleases() uint64 {
+	if b.MaxReleases == 0 {
+		return ReleaseTries
+	}
+	return b.MaxReleases
+}
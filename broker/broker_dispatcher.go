@@ -75,7 +75,9 @@ func (bd *BrokerDispatcher) RunAllTubes() (err error) {
 func (bd *BrokerDispatcher) runBroker(tube string, slot uint64) {
 	go func() {
 		b := New(bd.address, tube, slot, bd.cmd, nil)
-		b.Run(nil)
+		if err := b.Run(nil); err != nil {
+			log.Println(err)
+		}
 	}()
 }
 
@@ -1,13 +1,35 @@
 package broker
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math/big"
 	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/99designs/cmdstalk/bs"
 	"github.com/kr/beanstalk"
 )
 
@@ -45,13 +67,2311 @@ func TestWorkerSuccess(t *testing.T) {
 	assertTubeEmpty(tube)
 }
 
+// TestWorkerStderr demonstrates stderr is captured separately to stdout.
+func TestWorkerStderr(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+	expectStdout := []byte("out")
+	expectStderr := "err"
+
+	cmd := "echo -n out; echo -n err >&2; exit 1"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if result.JobId != id {
+		t.Fatalf("result.JobId %d != queueJob id %d", result.JobId, id)
+	}
+	if !bytes.Equal(result.Stdout, expectStdout) {
+		t.Fatalf("Stdout mismatch: '%s' != '%s'\n", result.Stdout, expectStdout)
+	}
+	if result.Stderr != expectStderr {
+		t.Fatalf("Stderr mismatch: '%s' != '%s'\n", result.Stderr, expectStderr)
+	}
+}
+
+// TestCaptureStdoutDisabled demonstrates stdout being discarded unread.
+func TestCaptureStdoutDisabled(t *testing.T) {
+	tube, _ := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "cat; [ -c /dev/stdout ]"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	capture := false
+	b.CaptureStdout = &capture
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if len(result.Stdout) != 0 || result.ExitStatus != 0 {
+		t.Fatalf("expected exit(0) with no stdout, got %+v", result)
+	}
+}
+
+// TestWorkerLargeBody feeds a body larger than the pipe buffer to a command
+// which echoes it to stdout while still reading stdin. The body is expanded
+// by Transform, since beanstalkd limits job size.
+func TestWorkerLargeBody(t *testing.T) {
+	tube, id := queueJob("x", 10, defaultTtr)
+	body := bytes.Repeat([]byte("x"), 512*1024)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "cat", results)
+	b.Transform = func([]byte) ([]byte, error) { return body, nil }
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	select {
+	case result := <-results:
+		if result.JobId != id {
+			t.Fatalf("result.JobId %d != queueJob id %d", result.JobId, id)
+		}
+		if result.Error != nil {
+			t.Fatalf("unexpected error: %s", result.Error)
+		}
+		if !bytes.Equal(result.Stdout, body) {
+			t.Fatalf("Stdout length %d != body length %d", len(result.Stdout), len(body))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for result")
+	}
+}
+
+// TestWorkerEnv demonstrates job metadata passed as environment variables.
+func TestWorkerEnv(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+	expectStdout := []byte(strconv.FormatUint(id, 10) + " " + tube + " 10 0")
+
+	cmd := `echo -n "$BEANSTALK_JOB_ID $BEANSTALK_TUBE $BEANSTALK_PRIORITY $BEANSTALK_RELEASES"`
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.IncludeJobStats = true
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if !bytes.Equal(result.Stdout, expectStdout) {
+		t.Fatalf("Stdout mismatch: '%s' != '%s'\n", result.Stdout, expectStdout)
+	}
+	if result.Stats["tube"] != tube || result.Stats["id"] != strconv.FormatUint(id, 10) {
+		t.Fatalf("result.Stats %v, expected job %d in %s", result.Stats, id, tube)
+	}
+}
+
+// TestTransform demonstrates the job body being transformed for stdin.
+func TestTransform(t *testing.T) {
+	tube, _ := queueJob("aGVsbG8gd29ybGQ=", 10, defaultTtr)
+	expectStdout := []byte("hello world")
+
+	cmd := "cat"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.Transform = func(body []byte) ([]byte, error) {
+		return base64.StdEncoding.DecodeString(string(body))
+	}
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if !bytes.Equal(result.Stdout, expectStdout) {
+		t.Fatalf("Stdout mismatch: '%s' != '%s'\n", result.Stdout, expectStdout)
+	}
+}
+
+// TestStdinBuilder demonstrates the job id prepended to the body on stdin.
+func TestStdinBuilder(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+	expectStdout := []byte(strconv.FormatUint(id, 10) + " " + tube + "\nhello world")
+
+	cmd := "cat"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.StdinBuilder = func(job JobInfo, body []byte) ([]byte, error) {
+		header := strconv.FormatUint(job.Id, 10) + " " + job.Tube + "\n"
+		return append([]byte(header), body...), nil
+	}
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if !bytes.Equal(result.Stdout, expectStdout) {
+		t.Fatalf("Stdout mismatch: '%s' != '%s'\n", result.Stdout, expectStdout)
+	}
+}
+
+// TestCmdTemplate demonstrates job fields interpolated into the command.
+func TestCmdTemplate(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+	expectStdout := []byte(strconv.FormatUint(id, 10) + " " + tube + " 10")
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "", results)
+	b.CmdTemplate = `echo -n {{.JobId}} {{quote .Tube}} {{.Stats.pri}}`
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if !bytes.Equal(result.Stdout, expectStdout) {
+		t.Fatalf("Stdout mismatch: '%s' != '%s'\n", result.Stdout, expectStdout)
+	}
+}
+
+func TestRenderCmd(t *testing.T) {
+	tmpl, err := parseCmdTemplate(`run {{quote .Tube}} {{.JobId}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := renderCmd(tmpl, JobInfo{Id: 7, Tube: "it's"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := `run 'it'\''s' 7`; cmd != expect {
+		t.Fatalf("renderCmd() = %q, expected %q", cmd, expect)
+	}
+
+	tmpl, err = parseCmdTemplate(`run {{.Stats.missing}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renderCmd(tmpl, JobInfo{Stats: map[string]string{}}); err == nil {
+		t.Fatal("expected an error for a missing stat")
+	}
+
+	if _, err := parseCmdTemplate(`run {{`); err == nil {
+		t.Fatal("expected an error for a malformed template")
+	}
+}
+
+// TestBatchSplit demonstrates a job executed once per record, and released
+// when a record fails.
+func TestBatchSplit(t *testing.T) {
+	tube, id := queueJob("a\nb\nc\n", 10, defaultTtr)
+
+	cmd := `read r; echo -n "$r"; [ "$r" != b ]`
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.BatchSplit = SplitLines
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+	if result.BatchRecords != 3 || result.BatchCompleted != 1 || result.ExitStatus != 1 {
+		t.Fatalf("expected failure at record 2 of 3, got %+v", result)
+	}
+	if string(result.Stdout) != "ab" {
+		t.Fatalf("Stdout mismatch: '%s' != 'ab'", result.Stdout)
+	}
+	assertJobStat(t, id, "state", "ready")
+	assertJobStat(t, id, "releases", "1")
+}
+
+func TestSplitLines(t *testing.T) {
+	records := SplitLines([]byte("one\n\ntwo\n"))
+	if len(records) != 2 || string(records[0]) != "one" || string(records[1]) != "two" {
+		t.Fatalf("SplitLines() = %q, expected [one two]", records)
+	}
+	if records := SplitLines(nil); len(records) != 0 {
+		t.Fatalf("SplitLines(nil) = %q, expected none", records)
+	}
+}
+
+// TestBodyViaTempFile demonstrates the job body passed in a temporary file.
+func TestBodyViaTempFile(t *testing.T) {
+	tube, _ := queueJob("hello world", 10, defaultTtr)
+	expectStdout := []byte("hello world")
+
+	cmd := `cat "$BEANSTALK_JOB_FILE"`
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.BodyVia = BodyViaTempFile
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if !bytes.Equal(result.Stdout, expectStdout) {
+		t.Fatalf("Stdout mismatch: '%s' != '%s'\n", result.Stdout, expectStdout)
+	}
+}
+
+// TestNullStdinOnEmpty demonstrates /dev/null as stdin for an empty body.
+func TestNullStdinOnEmpty(t *testing.T) {
+	tube, _ := queueJob("", 10, defaultTtr)
+	expectStdout := []byte("null")
+
+	cmd := `[ -c /dev/stdin ] && echo -n null`
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.NullStdinOnEmpty = true
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if !bytes.Equal(result.Stdout, expectStdout) {
+		t.Fatalf("Stdout mismatch: '%s' != '%s'\n", result.Stdout, expectStdout)
+	}
+}
+
+// TestWorkDirAndEnv demonstrates the worker's directory and extra env.
+func TestWorkDirAndEnv(t *testing.T) {
+	tube, _ := queueJob("hello world", 10, defaultTtr)
+	expectStdout := []byte("/ bar")
+
+	cmd := `echo -n "$(pwd) $FOO"`
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.WorkDir = "/"
+	b.Env = []string{"FOO=bar"}
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if !bytes.Equal(result.Stdout, expectStdout) {
+		t.Fatalf("Stdout mismatch: '%s' != '%s'\n", result.Stdout, expectStdout)
+	}
+}
+
 // TestWorkerFailure demonstrates a failed exit(1) task (release).
 func TestWorkerFailure(t *testing.T) {
 	tube, id := queueJob("hello world", 10, defaultTtr)
 
-	cmd := "false"
+	cmd := "false"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if result.JobId != id {
+		t.Fatalf("result.JobId %d != queueJob id %d", result.JobId, id)
+	}
+
+	if result.ExitStatus != 1 {
+		t.Fatalf("result.ExitStatus %d, expected 1", result.ExitStatus)
+	}
+
+	assertJobStat(t, id, "state", "ready")
+	assertJobStat(t, id, "releases", "1")
+	assertJobStat(t, id, "pri", "10")
+}
+
+// TestReleasePriorityOffset demonstrates a failed job released at a lower
+// priority.
+func TestReleasePriorityOffset(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "false"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.ReleasePriorityOffset = 100
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+	<-results
+
+	assertJobStat(t, id, "state", "ready")
+	assertJobStat(t, id, "pri", "110")
+}
+
+// TestWorkerBury demonstrates an exit(2) task (bury).
+func TestWorkerBury(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "exit 2"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if result.JobId != id {
+		t.Fatalf("result.JobId %d != queueJob id %d", result.JobId, id)
+	}
+	if result.ExitStatus != 2 {
+		t.Fatalf("result.ExitStatus %d, expected 2", result.ExitStatus)
+	}
+	if !result.Buried {
+		t.Fatalf("Expected job %d JobResult.Buried", id)
+	}
+
+	assertJobStat(t, id, "state", "buried")
+	assertJobStat(t, id, "pri", "10")
+}
+
+// TestExecError demonstrates a command which fails to start being released
+// with the failure on the result, rather than stopping Run.
+func TestExecError(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "true", results)
+	b.Env = []string{"FOO=b\x00ar"}
+
+	ticks := make(chan bool)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Run(ticks)
+	}()
+	ticks <- true // handle a single job
+
+	result := <-results
+	if result.Err == nil || result.CommandNotFound || result.ExitStatus != -1 {
+		t.Fatalf("expected an execution error, got %+v", result)
+	}
+	if !errors.Is(result.Err, ErrCommandStart) {
+		t.Fatalf("expected ErrCommandStart, got %v", result.Err)
+	}
+	assertJobStat(t, id, "state", "ready")
+
+	close(ticks)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestErrorTypes demonstrates errors being matched by category with
+// errors.Is, and by type with errors.As.
+func TestErrorTypes(t *testing.T) {
+	b := New("127.0.0.1:1", "cmdstalk-errors", 0, "true", nil)
+	b.ReconnectTries = 1
+	err := b.Run(nil)
+	if !errors.Is(err, ErrDial) {
+		t.Fatalf("expected ErrDial, got %v", err)
+	}
+
+	err = &JobError{JobId: 42, Err: &actionError{action: Bury, jobId: 42, err: errors.New("boom")}}
+	if !errors.Is(err, ErrTerminalOp) {
+		t.Fatalf("expected ErrTerminalOp, got %v", err)
+	}
+	var jobErr *JobError
+	if !errors.As(err, &jobErr) || jobErr.JobId != 42 {
+		t.Fatalf("expected a JobError for job 42, got %v", err)
+	}
+}
+
+// TestConnectionLostDuringJob demonstrates a job's delete being performed
+// on a new connection after the one it was reserved on drops while its
+// command runs, rather than it being handled again.
+func TestConnectionLostDuringJob(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "sleep 1", results)
+
+	var conns []*beanstalk.Conn
+	b.ConnectHook = func(conn *beanstalk.Conn) error {
+		conns = append(conns, conn)
+		return nil
+	}
+	b.OnEvent = func(ev Event) {
+		if ev.Phase == PhaseStart {
+			conns[0].Close() // the job returns to ready
+		}
+	}
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+	if result.Error != nil || result.IntendedAction != Delete {
+		t.Fatalf("expected job to be deleted, got %+v", result)
+	}
+	if len(conns) != 2 {
+		t.Fatalf("%d connections, expected a reconnect", len(conns))
+	}
+
+	c, err := beanstalk.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.StatsJob(id); !bs.NotFound(err) {
+		t.Fatalf("expected job %d to be deleted, got %v", id, err)
+	}
+}
+
+// TestFake demonstrates a broker handling jobs from an in-memory beanstalkd.
+func TestFake(t *testing.T) {
+	fake := bs.NewFake()
+	conn := fake.Conn()
+	ok, _ := conn.Put("fake", []byte("echo -n hello"), 10, 0, defaultTtr)
+	failed, _ := conn.Put("fake", []byte("exit 1"), 20, 0, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New("", "fake", 0, "sh", results)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+
+	ticks <- true
+	if result := <-results; result.JobId != ok || string(result.Stdout) != "hello" || result.ExitStatus != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	ticks <- true
+	if result := <-results; result.JobId != failed || result.ExitStatus != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	if _, err := conn.StatsJob(ok); !bs.NotFound(err) {
+		t.Fatalf("expected job %d to be deleted, got %v", ok, err)
+	}
+	stats, err := conn.StatsJob(failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["releases"] != "1" {
+		t.Fatalf("job %d released %s times, expected once", failed, stats["releases"])
+	}
+}
+
+// TestCmdByTube demonstrates jobs from different tubes running different
+// commands.
+func TestCmdByTube(t *testing.T) {
+	fake := bs.NewFake()
+	conn := fake.Conn()
+	conn.Put("images", []byte("a"), 10, 0, defaultTtr)
+	conn.Put("emails", []byte("b"), 20, 0, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New("", "", 0, "echo -n default", results)
+	b.Tubes = []string{"images", "emails"}
+	b.CmdByTube = map[string]string{"images": "echo -n images"}
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+
+	for _, expect := range []string{"images", "default"} {
+		ticks <- true
+		if result := <-results; string(result.Stdout) != expect {
+			t.Fatalf("stdout %q, expected %q", result.Stdout, expect)
+		}
+	}
+}
+
+// TestHeartbeat demonstrates an idle broker logging that it is alive.
+func TestHeartbeat(t *testing.T) {
+	fake := bs.NewFake()
+	var buf bytes.Buffer
+	b := New("", "idle", 0, "true", nil)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	b.LogOutput = &buf
+	b.HeartbeatInterval = 50 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := b.RunContext(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(buf.String(), "idle, watching idle"); n < 2 {
+		t.Fatalf("%d heartbeats logged, expected several:\n%s", n, buf.String())
+	}
+}
+
+// TestPrefetch demonstrates jobs being reserved while an earlier one is
+// handled, and then handled in order.
+func TestPrefetch(t *testing.T) {
+	fake := bs.NewFake()
+	conn := fake.Conn()
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		id, _ := conn.Put("prefetch", []byte("sleep 0.2"), 10, 0, defaultTtr)
+		ids = append(ids, id)
+	}
+
+	results := make(chan *JobResult)
+	b := New("", "prefetch", 0, "sh", results)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	b.Prefetch = 2
+
+	ticks := make(chan bool)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Run(ticks)
+	}()
+
+	ticks <- true
+	if result := <-results; result.JobId != ids[0] {
+		t.Fatalf("result for job %d, expected %d", result.JobId, ids[0])
+	}
+	for _, id := range ids[1:] {
+		if stats, _ := conn.StatsJob(id); stats["state"] != "reserved" {
+			t.Fatalf("job %d %s, expected it to be prefetched", id, stats["state"])
+		}
+	}
+
+	for _, id := range ids[1:] {
+		ticks <- true
+		if result := <-results; result.JobId != id || result.ExitStatus != 0 {
+			t.Fatalf("unexpected result %+v, expected job %d", result, id)
+		}
+	}
+	close(ticks)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := fake.Len(); n != 0 {
+		t.Fatalf("%d jobs left, expected none", n)
+	}
+}
+
+// TestSuccessValidator demonstrates a job which exits 0 being released
+// because of what it wrote to stderr.
+func TestSuccessValidator(t *testing.T) {
+	fake := bs.NewFake()
+	conn := fake.Conn()
+	ok, _ := conn.Put("validate", []byte("echo fine >&2"), 10, 0, defaultTtr)
+	soft, _ := conn.Put("validate", []byte("echo ERROR: try later >&2"), 20, 0, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New("", "validate", 0, "sh", results)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	b.SuccessValidator = func(result *JobResult) Action {
+		if strings.Contains(result.Stderr, "ERROR") {
+			return Release
+		}
+		return NoAction
+	}
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+
+	ticks <- true
+	if result := <-results; result.JobId != ok || result.IntendedAction != Delete {
+		t.Fatalf("unexpected result %+v, expected job %d deleted", result, ok)
+	}
+	ticks <- true
+	if result := <-results; result.JobId != soft || result.IntendedAction != Release {
+		t.Fatalf("unexpected result %+v, expected job %d released", result, soft)
+	}
+}
+
+// TestSlowJobThreshold demonstrates a slow job being reported and counted
+// while still being deleted.
+func TestSlowJobThreshold(t *testing.T) {
+	fake := bs.NewFake()
+	conn := fake.Conn()
+	conn.Put("slow", []byte("sleep 0.2"), 10, 0, defaultTtr)
+	conn.Put("slow", []byte("true"), 20, 0, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New("", "slow", 0, "sh", results)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	b.SlowJobThreshold = 100 * time.Millisecond
+	var slow []uint64
+	b.OnEvent = func(ev Event) {
+		if ev.Phase == PhaseSlow {
+			slow = append(slow, ev.JobId)
+		}
+	}
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	var ids []uint64
+	for i := 0; i < 2; i++ {
+		ticks <- true
+		result := <-results
+		if result.IntendedAction != Delete {
+			t.Fatalf("unexpected result %+v, expected job to be deleted", result)
+		}
+		ids = append(ids, result.JobId)
+	}
+
+	if len(slow) != 1 || slow[0] != ids[0] {
+		t.Fatalf("slow jobs %v, expected job %d", slow, ids[0])
+	}
+	if n := b.shared.counters.Slow(); n != 1 {
+		t.Fatalf("%d slow jobs counted, expected 1", n)
+	}
+}
+
+// TestHookPanic demonstrates a panicking hook releasing its job rather than
+// crashing the broker, which carries on with the next job.
+func TestHookPanic(t *testing.T) {
+	fake := bs.NewFake()
+	conn := fake.Conn()
+	bad, _ := conn.Put("panic", []byte("bad"), 10, 0, defaultTtr)
+	good, _ := conn.Put("panic", []byte("good"), 20, 0, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New("", "panic", 0, "cat", results)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	b.LogOutput = io.Discard
+	b.Transform = func(body []byte) ([]byte, error) {
+		if string(body) == "bad" {
+			panic("bad job")
+		}
+		return body, nil
+	}
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+
+	ticks <- true
+	result := <-results
+	if result.JobId != bad || result.Error == nil || !strings.Contains(result.Error.Error(), "panic in Transform: bad job") {
+		t.Fatalf("unexpected result %+v, expected a panic for job %d", result, bad)
+	}
+	if stats, _ := conn.StatsJob(bad); stats["state"] != "ready" {
+		t.Fatalf("job %d %s, expected it to be released", bad, stats["state"])
+	}
+	if n := b.shared.recoveredPanics.Load(); n != 1 {
+		t.Fatalf("%d panics recovered, expected 1", n)
+	}
+
+	conn.Delete(bad)
+	ticks <- true
+	if result := <-results; result.JobId != good || result.Error != nil {
+		t.Fatalf("unexpected result %+v, expected job %d to succeed", result, good)
+	}
+}
+
+// TestDumpDir demonstrates draining a tube to files without executing or
+// deleting any job.
+func TestDumpDir(t *testing.T) {
+	fake := bs.NewFake()
+	conn := fake.Conn()
+	first, _ := conn.Put("dump", []byte("one"), 10, 0, defaultTtr)
+	second, _ := conn.Put("dump", []byte("two"), 20, 0, defaultTtr)
+
+	dir := t.TempDir()
+	results := make(chan *JobResult, 2)
+	b := New("", "dump", 0, "false", results)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	b.DumpDir = dir
+	if err := b.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []uint64{first, second} {
+		result := <-results
+		if result.JobId != id || result.Executed || result.IntendedAction != Release {
+			t.Fatalf("unexpected result %+v", result)
+		}
+	}
+	for id, body := range map[uint64]string{first: "one", second: "two"} {
+		got, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("dump-%d", id)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != body {
+			t.Fatalf("job %d dumped %q, expected %q", id, got, body)
+		}
+		stats, err := conn.StatsJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats["state"] != "ready" || stats["releases"] != "1" {
+			t.Fatalf("job %d left %s after %s releases", id, stats["state"], stats["releases"])
+		}
+	}
+
+	// MaxJobs dumps a bounded sample.
+	sample := t.TempDir()
+	b = New("", "dump", 0, "false", nil)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	b.DumpDir = sample
+	b.MaxJobs = 1
+	if err := b.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(sample); len(files) != 1 {
+		t.Fatalf("dumped %d jobs, expected 1", len(files))
+	}
+}
+
+// throttleClock is the real clock, recording whether After was called
+// with throttle.
+type throttleClock struct {
+	realClock
+	throttle time.Duration
+	waited   atomic.Bool
+}
+
+func (c *throttleClock) After(d time.Duration) <-chan time.Time {
+	if d == c.throttle {
+		c.waited.Store(true)
+	}
+	return c.realClock.After(d)
+}
+
+// TestThrottle demonstrates the pause after each job being cut short by
+// cancellation, and skipped when Throttle is zero.
+func TestThrottle(t *testing.T) {
+	fake := bs.NewFake()
+	conn := fake.Conn()
+	conn.Put("throttle", []byte("one"), 10, 0, defaultTtr)
+	conn.Put("throttle", []byte("two"), 10, 0, defaultTtr)
+
+	clock := &throttleClock{}
+	results := make(chan *JobResult)
+	b := New("", "throttle", 0, "true", results)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	b.Clock = clock
+	ticks := make(chan bool)
+	done := make(chan error)
+	go func() { done <- b.Run(ticks) }()
+	for i := 0; i < 2; i++ {
+		ticks <- true
+		<-results
+	}
+	close(ticks)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if clock.waited.Load() {
+		t.Fatal("throttled with no Throttle")
+	}
+
+	conn.Put("throttle", []byte("three"), 10, 0, defaultTtr)
+	clock = &throttleClock{throttle: time.Hour}
+	b = New("", "throttle", 0, "true", results)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	b.Clock = clock
+	b.Throttle = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { done <- b.RunContext(ctx, nil) }()
+	<-results
+	for !clock.waited.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RunContext still throttling after cancellation")
+	}
+}
+
+// sleepClock records sleeps instead of sleeping, and is otherwise real.
+type sleepClock struct {
+	realClock
+	slept atomic.Int64
+}
+
+func (c *sleepClock) Sleep(d time.Duration) {
+	c.slept.Add(int64(d))
+}
+
+// TestDeadlineSoonClock demonstrates the pause after DEADLINE_SOON being
+// taken with Clock.
+func TestDeadlineSoonClock(t *testing.T) {
+	fake := bs.NewFake()
+	fake.Conn().Put("deadline", []byte("hello"), 10, 0, defaultTtr)
+	fake.Fail("reserve-with-timeout", beanstalk.ErrDeadline)
+
+	clock := &sleepClock{}
+	results := make(chan *JobResult)
+	b := New("", "deadline", 0, "true", results)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	b.Clock = clock
+
+	ticks := make(chan bool)
+	go b.Run(ticks)
+	ticks <- true
+	<-results
+	close(ticks)
+
+	if d := time.Duration(clock.slept.Load()); d != bs.DeadlineSoonDelay {
+		t.Fatalf("slept %v with Clock, expected %v", d, bs.DeadlineSoonDelay)
+	}
+}
+
+// TestBuryPriority demonstrates buried jobs keeping their reserved priority,
+// or taking BuryPriority if set.
+func TestBuryPriority(t *testing.T) {
+	fake := bs.NewFake()
+	conn := fake.Conn()
+	kept, _ := conn.Put("bury", []byte("kept"), 10, 0, defaultTtr)
+	replaced, _ := conn.Put("bury", []byte("replaced"), 20, 0, defaultTtr)
+
+	buryPri := uint32(5000)
+	for _, c := range []struct {
+		id           uint64
+		buryPriority *uint32
+		pri          string
+	}{
+		{kept, nil, "10"},
+		{replaced, &buryPri, "5000"},
+	} {
+		results := make(chan *JobResult)
+		b := New("", "bury", 0, "true", results)
+		b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+		b.ActionFor = func(int) Action { return Bury }
+		b.BuryPriority = c.buryPriority
+
+		ticks := make(chan bool)
+		go b.Run(ticks)
+		ticks <- true
+		if result := <-results; result.JobId != c.id || !result.Buried {
+			t.Fatalf("unexpected result %+v", result)
+		}
+		close(ticks)
+
+		stats, err := conn.StatsJob(c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats["state"] != "buried" || stats["pri"] != c.pri {
+			t.Fatalf("job %d %s with priority %s, expected buried with %s", c.id, stats["state"], stats["pri"], c.pri)
+		}
+	}
+}
+
+// TestJSONLogs demonstrates concurrent workers writing whole JSON lines to
+// a LogOutput which isn't safe for concurrent use; run with -race.
+func TestJSONLogs(t *testing.T) {
+	fake := bs.NewFake()
+	for i := 0; i < 40; i++ {
+		fake.Conn().Put("json", []byte("hello"), 10, 0, defaultTtr)
+	}
+
+	var buf bytes.Buffer
+	results := make(chan *JobResult)
+	b := New("", "json", 0, "true", results)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	b.Concurrency = 8
+	b.JSONLogs = true
+	b.LogOutput = &buf
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- b.RunContext(ctx, nil) }()
+	for i := 0; i < 40; i++ {
+		<-results
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var ev map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("line %q isn't JSON: %s", line, err)
+		}
+		if ev["tube"] != "json" {
+			t.Fatalf("line %q has no tube", line)
+		}
+	}
+}
+
+// TestSleepWhilePausedReserveTimeout demonstrates SleepWhilePaused capping
+// the reserve timeout under Run, so that an idle broker checks whether its
+// tubes are paused within PauseCheckInterval.
+func TestSleepWhilePausedReserveTimeout(t *testing.T) {
+	fake := bs.NewFake()
+	fake.Conn().Put("paused", []byte("hello"), 10, 0, defaultTtr)
+	timeouts := make(chan time.Duration, 1)
+
+	results := make(chan *JobResult)
+	b := New("", "paused", 0, "true", results)
+	b.Dial = func() (bs.Conn, error) { return timeoutConn{fake.Conn(), timeouts}, nil }
+	b.SleepWhilePaused = true
+
+	ticks := make(chan bool)
+	go b.Run(ticks)
+	ticks <- true
+	<-results
+	close(ticks)
+
+	if timeout := <-timeouts; timeout > PauseCheckInterval {
+		t.Fatalf("reserved with timeout %v, expected at most %v", timeout, PauseCheckInterval)
+	}
+}
+
+// timeoutConn sends the timeout of each reserve to timeouts.
+type timeoutConn struct {
+	bs.Conn
+	timeouts chan time.Duration
+}
+
+func (c timeoutConn) NewReserver(tubes ...string) bs.Reserver {
+	return timeoutReserver{c.Conn.NewReserver(tubes...), c.timeouts}
+}
+
+type timeoutReserver struct {
+	bs.Reserver
+	timeouts chan time.Duration
+}
+
+func (r timeoutReserver) Reserve(timeout time.Duration) (uint64, []byte, error) {
+	select {
+	case r.timeouts <- timeout:
+	default:
+	}
+	return r.Reserver.Reserve(timeout)
+}
+
+// TestMaxBodyBytes demonstrates an oversized job being buried unexecuted.
+func TestMaxBodyBytes(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "true", results)
+	b.MaxBodyBytes = 5
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+	if !result.Rejected || result.Executed {
+		t.Fatalf("expected job to be rejected unexecuted, got %+v", result)
+	}
+	assertJobStat(t, id, "state", "buried")
+
+	stats, err := b.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RejectedJobs != 1 {
+		t.Fatalf("stats.RejectedJobs %d, expected 1", stats.RejectedJobs)
+	}
+}
+
+// TestJobLost demonstrates a job whose TTR expires before it is deleted
+// being counted and left to beanstalkd, rather than stopping Run.
+func TestJobLost(t *testing.T) {
+	tube, id := queueJob("hello world", 10, time.Second)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "true", results)
+	b.Transform = func(body []byte) ([]byte, error) {
+		time.Sleep(2 * time.Second) // outlive the TTR
+		return body, nil
+	}
+
+	ticks := make(chan bool)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Run(ticks)
+	}()
+	ticks <- true // handle a single job
+
+	result := <-results
+	if result.Error != nil {
+		t.Fatalf("unexpected error: %s", result.Error)
+	}
+	assertJobStat(t, id, "state", "ready")
+
+	stats, err := b.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.LostJobs != 1 {
+		t.Fatalf("stats.LostJobs %d, expected 1", stats.LostJobs)
+	}
+
+	close(ticks)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOnStart demonstrates a failing OnStart stopping Run before any job is
+// reserved.
+func TestOnStart(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	b := New(address, tube, 0, "true", nil)
+	b.OnStart = func() error {
+		return errors.New("dependency unavailable")
+	}
+
+	err := b.Run(nil)
+	if err == nil || !strings.Contains(err.Error(), "dependency unavailable") {
+		t.Fatalf("Run returned %v, expected the OnStart error", err)
+	}
+	assertJobStat(t, id, "state", "ready")
+}
+
+// TestPersistent demonstrates jobs handled by a single long-lived worker,
+// which is restarted after it dies.
+func TestPersistent(t *testing.T) {
+	tube, id := queueJob("hello\nworld", 1, defaultTtr)
+	id2 := putJob(tube, "die", 2, defaultTtr)
+	id3 := putJob(tube, "again", 3, defaultTtr)
+
+	// Upper-cases each body, exiting instead if it is "die".
+	cmd := `export LC_ALL=C
+while read -r id len; do
+	read -r -N "$len" body
+	[ "$body" = die ] && exit 1
+	out="$$:${body^^}"
+	printf '0 %d\n%s' "${#out}" "$out"
+done`
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.Persistent = true
+	b.ReleasePriorityOffset = 100 // keep the released job behind the next
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+
+	ticks <- true
+	first := <-results
+	pid, stdout, _ := strings.Cut(string(first.Stdout), ":")
+	if first.JobId != id || stdout != "HELLO\nWORLD" {
+		t.Fatalf("unexpected result %+v", first)
+	}
+
+	ticks <- true
+	second := <-results
+	if second.JobId != id2 || second.Err == nil {
+		t.Fatalf("expected worker to die, got %+v", second)
+	}
+	assertJobStat(t, id2, "state", "ready")
+
+	ticks <- true
+	third := <-results
+	if third.JobId != id3 || strings.HasPrefix(string(third.Stdout), pid+":") {
+		t.Fatalf("expected a restarted worker, got %+v", third)
+	}
+}
+
+// TestCommandNotFound demonstrates a missing command burying the job
+// without stopping the broker.
+func TestCommandNotFound(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "", results)
+	b.Command = []string{"/nonexistent/cmdstalk-worker"}
+
+	ticks := make(chan bool)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Run(ticks)
+	}()
+	ticks <- true // handle a single job
+
+	result := <-results
+	if !result.CommandNotFound || result.ExitStatus != ExitCommandNotFound {
+		t.Fatalf("expected command not found, got %+v", result)
+	}
+	assertJobStat(t, id, "state", "buried")
+
+	select {
+	case err := <-done:
+		t.Fatalf("Run returned %v after a missing command", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(ticks)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPoisonThreshold demonstrates a job buried without execution once its
+// reserves and releases exceed PoisonThreshold.
+func TestPoisonThreshold(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "exit 1", results)
+	b.PoisonThreshold = 2
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+
+	ticks <- true
+	if result := <-results; !result.Executed || result.Reserves != 1 {
+		t.Fatalf("expected first reserve to execute, got %+v", result)
+	}
+
+	ticks <- true
+	result := <-results
+	if result.Executed || !result.Buried {
+		t.Fatalf("expected job to be buried without executing, got %+v", result)
+	}
+	if result.Reserves != 2 || result.Releases != 1 {
+		t.Fatalf("Reserves %d, Releases %d, expected 2 and 1", result.Reserves, result.Releases)
+	}
+	assertJobStat(t, id, "state", "buried")
+}
+
+// TestWorkerSignaled demonstrates a worker killed by a signal, with
+// SignaledAction (release).
+func TestWorkerSignaled(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "kill -KILL $$"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.SignaledAction = Release
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if !result.Signaled || result.Signal != syscall.SIGKILL {
+		t.Fatalf("Expected job %d killed by SIGKILL, got %+v", id, result)
+	}
+	assertJobStat(t, id, "state", "ready")
+	assertJobStat(t, id, "releases", "1")
+}
+
+// TestLimitCPU demonstrates a command exceeding LimitCPU being killed.
+func TestLimitCPU(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "while :; do :; done"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.LimitCPU = time.Second
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+	if !result.Signaled {
+		t.Fatalf("expected the command to be killed, got %+v", result)
+	}
+	assertJobStat(t, id, "state", "ready")
+}
+
+func TestWorkerTimeout(t *testing.T) {
+	ttr := 1 * time.Second
+	tube, id := queueJob("TestWorkerTimeout", 10, ttr)
+
+	cmd := "sleep 4"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+
+	start := time.Now()
+	ticks <- true // handle a single job
+	result := <-results
+	duration := time.Since(start)
+
+	if duration < 1*time.Second {
+		t.Fatalf("%v too short to have timed out correctly", duration)
+	}
+
+	if !result.TimedOut {
+		t.Fatalf("Expected job %d JobResult.TimedOut to be true", id)
+	}
+	if result.Duration < 1*time.Second {
+		t.Fatalf("result.Duration %v too short to have timed out", result.Duration)
+	}
+
+	assertJobStat(t, id, "state", "ready")
+	assertJobStat(t, id, "timeouts", "1")
+
+	ticks <- true // handle another job
+	result = <-results
+	if !result.Buried {
+		t.Fatalf("Expected job %d JobResult.Buried", id)
+	}
+	assertJobStat(t, id, "state", "buried")
+	assertJobStat(t, id, "timeouts", "1")
+}
+
+// TestWorkerJobTimeout demonstrates a worker exceeding JobTimeout (release).
+func TestWorkerJobTimeout(t *testing.T) {
+	tube, id := queueJob("TestWorkerJobTimeout", 10, defaultTtr)
+
+	cmd := "sleep 4"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.JobTimeout = 1 * time.Second
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+
+	start := time.Now()
+	ticks <- true // handle a single job
+	result := <-results
+	duration := time.Since(start)
+
+	if duration > 3*time.Second {
+		t.Fatalf("%v too long, worker should have been killed", duration)
+	}
+	if !result.JobTimedOut {
+		t.Fatalf("Expected job %d JobResult.JobTimedOut to be true", id)
+	}
+
+	assertJobStat(t, id, "releases", "1")
+}
+
+// TestKillGrace demonstrates a worker cleaning up after KillSignal when it
+// exceeds JobTimeout.
+func TestKillGrace(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	cmd := `trap 'echo -n cleaned; exit 1' TERM; sleep 10 & wait`
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.JobTimeout = 500 * time.Millisecond
+	b.KillGrace = 5 * time.Second
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+	if !result.JobTimedOut || !result.GracefulStop {
+		t.Fatalf("expected a graceful stop after job timeout, got %+v", result)
+	}
+	if string(result.Stdout) != "cleaned" {
+		t.Fatalf("Stdout mismatch: '%s' != 'cleaned'", result.Stdout)
+	}
+	assertJobStat(t, id, "state", "ready")
+}
+
+// TestWorkerStdoutReadTimeout demonstrates a worker whose stdout goes idle
+// for longer than StdoutReadTimeout (release).
+func TestWorkerStdoutReadTimeout(t *testing.T) {
+	tube, id := queueJob("TestWorkerStdoutReadTimeout", 10, defaultTtr)
+
+	cmd := "echo started; sleep 4"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.StdoutReadTimeout = 1 * time.Second
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+
+	start := time.Now()
+	ticks <- true // handle a single job
+	result := <-results
+	duration := time.Since(start)
+
+	if duration > 3*time.Second {
+		t.Fatalf("%v too long, worker should have been killed", duration)
+	}
+	if !result.StalledIO {
+		t.Fatalf("Expected job %d JobResult.StalledIO to be true", id)
+	}
+
+	assertJobStat(t, id, "releases", "1")
+}
+
+// TestCancelJob demonstrates a running job cancelled (release).
+func TestCancelJob(t *testing.T) {
+	tube, id := queueJob("TestCancelJob", 10, defaultTtr)
+
+	cmd := "sleep 4"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	for !b.CancelJob(id) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	result := <-results
+
+	if !result.Cancelled {
+		t.Fatalf("Expected job %d JobResult.Cancelled to be true", id)
+	}
+	if b.CancelJob(id) {
+		t.Fatalf("Expected job %d to no longer be running", id)
+	}
+	assertJobStat(t, id, "releases", "1")
+}
+
+// TestDrain demonstrates a job outliving the drain timeout (release).
+func TestDrain(t *testing.T) {
+	tube, id := queueJob("TestDrain", 10, defaultTtr)
+
+	cmd := "sleep 4"
+	results := make(chan *JobResult, 1)
+	b := New(address, tube, 0, cmd, results)
+
+	done := make(chan error)
+	go func() {
+		done <- b.Run(nil)
+	}()
+	for b.shared.busy.Load() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := b.Drain(500 * time.Millisecond); err == nil {
+		t.Fatal("Expected Drain to time out")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if result := <-results; !result.Cancelled {
+		t.Fatalf("Expected job %d JobResult.Cancelled to be true", id)
+	}
+	assertJobStat(t, id, "releases", "1")
+}
+
+// TestDrainIdle demonstrates Drain cutting short a reserve waiting the
+// default day under Run, while a cancellable RunContext waits a second.
+func TestDrainIdle(t *testing.T) {
+	fake := bs.NewFake()
+	b := New("", "idle", 0, "true", nil)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+
+	done := make(chan error)
+	go func() { done <- b.Run(nil) }()
+	waitReserving(&b)
+	if d := b.defaultReserveTimeout(); d != DefaultReserveTimeout {
+		t.Fatalf("reserve timeout %v under Run, expected %v", d, DefaultReserveTimeout)
+	}
+	if err := b.Drain(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := b.shared.lastErr; err != nil {
+		t.Fatalf("closing the reserving connection recorded error %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b = New("", "idle", 0, "true", nil)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	go func() { done <- b.RunContext(ctx, nil) }()
+	waitReserving(&b)
+	if d := b.defaultReserveTimeout(); d != ContextReserveTimeout {
+		t.Fatalf("reserve timeout %v under RunContext, expected %v", d, ContextReserveTimeout)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDrainReserved demonstrates a job reserved just as Drain closes the
+// connection being left to return to ready rather than executed.
+func TestDrainReserved(t *testing.T) {
+	fake := bs.NewFake()
+	id, _ := fake.Conn().Put("drain", []byte("hello"), 10, 0, defaultTtr)
+	conn := &drainConn{
+		Conn:     fake.Conn(),
+		reserved: make(chan struct{}),
+		proceed:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+
+	results := make(chan *JobResult, 1)
+	b := New("", "drain", 0, "true", results)
+	b.Dial = func() (bs.Conn, error) { return conn, nil }
+
+	done := make(chan error)
+	go func() { done <- b.Run(nil) }()
+	<-conn.reserved
+	drained := make(chan error)
+	go func() { drained <- b.Drain(time.Second) }()
+	<-conn.closed
+	close(conn.proceed)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if len(results) > 0 {
+		t.Fatalf("unexpected result %+v", <-results)
+	}
+	stats, err := fake.Conn().StatsJob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["state"] != "ready" || stats["releases"] != "0" {
+		t.Fatalf("job %s with %s releases, expected ready with none", stats["state"], stats["releases"])
+	}
+}
+
+// drainConn holds up its first reserve, having reserved a job, until
+// proceed is closed, signalling closed when it is closed meanwhile.
+type drainConn struct {
+	bs.Conn
+	reserved, proceed, closed chan struct{}
+	once                      sync.Once
+}
+
+func (c *drainConn) NewReserver(tubes ...string) bs.Reserver {
+	return drainReserver{c.Conn.NewReserver(tubes...), c}
+}
+
+func (c *drainConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+type drainReserver struct {
+	bs.Reserver
+	c *drainConn
+}
+
+func (r drainReserver) Reserve(timeout time.Duration) (uint64, []byte, error) {
+	id, body, err := r.Reserver.Reserve(timeout)
+	select {
+	case <-r.c.proceed:
+	default:
+		close(r.c.reserved)
+		<-r.c.proceed
+	}
+	return id, body, err
+}
+
+// waitReserving waits for one of b's workers to be waiting in reserve.
+func waitReserving(b *Broker) {
+	for {
+		b.shared.mu.Lock()
+		n := 0
+		if b.shared.run != nil {
+			n = len(b.shared.run.reserving)
+		}
+		b.shared.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestWorkerKeepAlive demonstrates a worker outliving its TTR with KeepAlive.
+func TestWorkerKeepAlive(t *testing.T) {
+	tube, id := queueJob("TestWorkerKeepAlive", 10, 1*time.Second)
+
+	cmd := "sleep 3"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.KeepAlive = true
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if result.TimedOut {
+		t.Fatalf("Expected job %d JobResult.TimedOut to be false", id)
+	}
+	if result.ExitStatus != 0 {
+		t.Fatalf("Unexpected exit status %d", result.ExitStatus)
+	}
+}
+
+// TestTubes demonstrates a broker servicing multiple tubes.
+func TestTubes(t *testing.T) {
+	tube1, id1 := queueJob("one", 10, defaultTtr)
+	tube2, id2 := queueJob("two", 10, defaultTtr)
+
+	cmd := "cat"
+	results := make(chan *JobResult)
+	b := New(address, "", 0, cmd, results)
+	b.Tubes = []string{tube1, tube2}
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+
+	tubes := make(map[uint64]string)
+	for i := 0; i < 2; i++ {
+		ticks <- true
+		result := <-results
+		tubes[result.JobId] = result.Tube
+	}
+
+	if tubes[id1] != tube1 || tubes[id2] != tube2 {
+		t.Fatalf("result tubes %v, expected %d:%s %d:%s", tubes, id1, tube1, id2, tube2)
+	}
+}
+
+// TestDefaultTubeIgnored demonstrates a broker not reserving from the
+// "default" tube, which beanstalkd watches on every new connection, unless
+// it is configured to.
+func TestDefaultTubeIgnored(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	c, err := beanstalk.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := beanstalk.Tube{Conn: c, Name: "default"}
+	defaultId, err := def.Put([]byte("not for cmdstalk"), 0, 0, defaultTtr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Delete(defaultId)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "true", results)
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	if result := <-results; result.JobId != id {
+		t.Fatalf("result.JobId %d, expected %d from %s", result.JobId, id, tube)
+	}
+	assertJobStat(t, defaultId, "state", "ready")
+}
+
+// TestMetrics demonstrates job outcomes being counted.
+func TestMetrics(t *testing.T) {
+	tube, _ := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "true"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	counters := &Counters{}
+	b.Metrics = counters
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+	<-results
+
+	if counters.Deleted() != 1 {
+		t.Fatalf("counters.Deleted() %d, expected 1", counters.Deleted())
+	}
+	if counters.Executed() != 1 {
+		t.Fatalf("counters.Executed() %d, expected 1", counters.Executed())
+	}
+}
+
+func TestOnEvent(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "exit 1", results)
+	var events []Event
+	b.OnEvent = func(ev Event) { events = append(events, ev) }
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+	<-results
+
+	expected := []Phase{PhaseReserve, PhaseStart, PhaseFinish, PhaseRelease}
+	if len(events) != len(expected) {
+		t.Fatalf("got %d events %v, expected %v", len(events), events, expected)
+	}
+	for i, ev := range events {
+		if ev.Phase != expected[i] || ev.JobId != id || ev.Tube != tube {
+			t.Fatalf("event %d is %+v, expected %s of job %d in %s", i, ev, expected[i], id, tube)
+		}
+	}
+	if events[3].ExitStatus != 1 {
+		t.Fatalf("release ExitStatus %d, expected 1", events[3].ExitStatus)
+	}
+	info, ok := JobInfoFromContext(events[3].Context)
+	if !ok || info.Id != id || info.Tube != tube || info.Stats["pri"] != "10" {
+		t.Fatalf("event context has JobInfo %+v, expected job %d in %s", info, id, tube)
+	}
+}
+
+// TestPauseResume demonstrates a paused broker reserving nothing until it
+// is resumed.
+func TestPauseResume(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "true", results)
+	b.Pause()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.RunContext(ctx, nil)
+
+	select {
+	case result := <-results:
+		t.Fatalf("job %d handled while paused", result.JobId)
+	case <-time.After(500 * time.Millisecond):
+	}
+	stats, err := b.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stats.Paused || stats.Tubes[tube].Ready != 1 {
+		t.Fatalf("expected paused with 1 job ready, got %+v", stats)
+	}
+
+	b.Resume()
+	select {
+	case result := <-results:
+		if result.JobId != id {
+			t.Fatalf("result.JobId %d != queueJob id %d", result.JobId, id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("job not handled after resume")
+	}
+}
+
+// TestPollIdle demonstrates a job put into an idle tube being picked up by
+// polling.
+func TestPollIdle(t *testing.T) {
+	tube, _ := queueJob("one", 10, defaultTtr)
+
+	cmd := "true"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.PollIdle = true
+	b.PollInterval = 100 * time.Millisecond
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true
+	<-results
+
+	ticks <- true // tube is now empty
+	time.Sleep(200 * time.Millisecond)
+	id := putJob(tube, "two", 10, defaultTtr)
+
+	select {
+	case result := <-results:
+		if result.JobId != id {
+			t.Fatalf("result.JobId %d != putJob id %d", result.JobId, id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for polled job")
+	}
+}
+
+// TestPollDelayed demonstrates polling sooner than PollInterval for a
+// delayed job which is nearly due.
+func TestPollDelayed(t *testing.T) {
+	tube, _ := queueJob("one", 10, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "true", results)
+	b.PollIdle = true
+	b.PollDelayed = true
+	b.PollInterval = 10 * time.Second
+
+	id, err := b.Put(tube, []byte("two"), 10, time.Second, defaultTtr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true
+	<-results
+
+	ticks <- true // only the delayed job is left
+	select {
+	case result := <-results:
+		if result.JobId != id {
+			t.Fatalf("result.JobId %d != Put id %d", result.JobId, id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for delayed job")
+	}
+}
+
+// TestConnectHook demonstrates a failing hook retried like a failed dial.
+func TestConnectHook(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "true"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.ReconnectDelay = 10 * time.Millisecond
+	calls := 0
+	b.ConnectHook = func(conn *beanstalk.Conn) error {
+		if calls++; calls == 1 {
+			return errors.New("not yet")
+		}
+		return nil
+	}
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	if result := <-results; result.JobId != id {
+		t.Fatalf("result.JobId %d != queueJob id %d", result.JobId, id)
+	}
+	if calls != 2 {
+		t.Fatalf("ConnectHook called %d times, expected 2", calls)
+	}
+}
+
+// TestRunContext demonstrates cancellation stopping a tickless broker.
+func TestRunContext(t *testing.T) {
+	tube, _ := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "true"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- b.RunContext(ctx, nil)
+	}()
+
+	<-results
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("RunContext did not return after cancel")
+	}
+}
+
+// TestMaxJobs demonstrates a tickless broker returning after MaxJobs.
+func TestMaxJobs(t *testing.T) {
+	tube, _ := queueJob("one", 10, defaultTtr)
+	putJob(tube, "two", 10, defaultTtr)
+
+	cmd := "true"
+	results := make(chan *JobResult, 2)
+	b := New(address, tube, 0, cmd, results)
+	b.MaxJobs = 2
+
+	if err := b.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%d results, expected 2", len(results))
+	}
+}
+
+// TestDeadLetterTube demonstrates an exhausted job moving to DeadLetterTube.
+func TestDeadLetterTube(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+	deadTube := tube + "-dead"
+
+	cmd := "false"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.MaxReleases = 1
+	b.DeadLetterTube = deadTube
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+
+	ticks <- true // release
+	<-results
+	ticks <- true // dead letter
+	result := <-results
+
+	if !result.DeadLettered {
+		t.Fatalf("Expected job %d JobResult.DeadLettered", id)
+	}
+	c, err := beanstalk.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.StatsJob(id); err == nil {
+		t.Fatalf("Expected job %d to be deleted", id)
+	}
+}
+
+// TestPipelineTube demonstrates stdout of a successful job enqueued
+// downstream, and the original deleted.
+func TestPipelineTube(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+	nextTube := tube + "-next"
+
+	cmd := "tr a-z A-Z"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.PipelineTube = nextTube
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+	result := <-results
+
+	if result.PipelineJobId == 0 {
+		t.Fatalf("Expected job %d JobResult.PipelineJobId", id)
+	}
+	c, err := beanstalk.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.StatsJob(id); err == nil {
+		t.Fatalf("Expected job %d to be deleted", id)
+	}
+	next := beanstalk.Tube{Conn: c, Name: nextTube}
+	nextId, body, err := next.PeekReady()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nextId != result.PipelineJobId || string(body) != "HELLO WORLD" {
+		t.Fatalf("%s has job %d %q, expected %d %q", nextTube, nextId, body, result.PipelineJobId, "HELLO WORLD")
+	}
+}
+
+// TestStats demonstrates broker counters and tube stats.
+func TestStats(t *testing.T) {
+	tube, _ := queueJob("one", 10, defaultTtr)
+	putJob(tube, "two", 10, defaultTtr)
+
+	cmd := "true"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+	<-results
+
+	stats, err := b.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Deleted != 1 {
+		t.Fatalf("stats.Deleted %d, expected 1", stats.Deleted)
+	}
+	if stats.Tubes[tube].Ready != 1 {
+		t.Fatalf("stats.Tubes[%s].Ready %d, expected 1", tube, stats.Tubes[tube].Ready)
+	}
+}
+
+// TestStatsPaused demonstrates a paused tube reported by Stats.
+func TestStatsPaused(t *testing.T) {
+	tube, _ := queueJob("one", 10, defaultTtr)
+
+	c, err := beanstalk.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := (&beanstalk.Tube{Conn: c, Name: tube}).Pause(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New(address, tube, 0, "true", nil)
+	stats, err := b.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := stats.Tubes[tube]; !ts.Paused || ts.PauseTimeLeft <= 0 {
+		t.Fatalf("stats.Tubes[%s] %+v, expected paused", tube, ts)
+	}
+}
+
+// TestDryRun demonstrates a successful job being released instead of deleted.
+func TestDryRun(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "true"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.DryRun = true
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if result.IntendedAction != Delete {
+		t.Fatalf("result.IntendedAction %v, expected %v", result.IntendedAction, Delete)
+	}
+
+	assertJobStat(t, id, "state", "ready")
+	assertJobStat(t, id, "pri", "10")
+}
+
+// TestHealthy demonstrates health reporting while connected.
+func TestHealthy(t *testing.T) {
+	tube, _ := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "true"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.HealthTimeout = 10 * time.Second
+
+	if b.Healthy() {
+		t.Fatal("Expected broker to be unhealthy before Run")
+	}
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+	<-results
+
+	if !b.Healthy() {
+		t.Fatal("Expected broker to be healthy after handling a job")
+	}
+}
+
+// TestResultsDrop demonstrates results being dropped rather than blocking.
+func TestResultsDrop(t *testing.T) {
+	tube, _ := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "true"
+	results := make(chan *JobResult) // never received from
+	b := New(address, tube, 0, cmd, results)
+	b.ResultsPolicy = ResultsDrop
+	b.MaxJobs = 1
+
+	if err := b.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := b.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.DroppedResults != 1 {
+		t.Fatalf("stats.DroppedResults %d, expected 1", stats.DroppedResults)
+	}
+}
+
+// TestPut demonstrates putting a job via the broker.
+func TestPut(t *testing.T) {
+	tube, _ := queueJob("hello world", 10, defaultTtr)
+	b := New(address, tube, 0, "true", nil)
+
+	id, err := b.Put(tube, []byte("another"), 20, 0, defaultTtr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertJobStat(t, id, "tube", tube)
+	assertJobStat(t, id, "pri", "20")
+}
+
+// TestKick demonstrates kicking a buried job back to ready.
+func TestKick(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	c, err := beanstalk.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := beanstalk.NewTubeSet(c, tube)
+	if _, _, err := ts.Reserve(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Bury(id, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New(address, tube, 0, "true", nil)
+	n, err := b.Kick(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("kicked %d, expected 1", n)
+	}
+	assertJobStat(t, id, "state", "ready")
+}
+
+// TestPeek demonstrates peeking at ready and buried jobs.
+func TestPeek(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+	b := New(address, tube, 0, "true", nil)
+
+	peekID, body, err := b.PeekReady()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peekID != id || string(body) != "hello world" {
+		t.Fatalf("PeekReady() = %d, %q, expected %d, %q", peekID, body, id, "hello world")
+	}
+
+	if _, _, err := b.PeekBuried(); !bs.NotFound(err) {
+		t.Fatalf("PeekBuried() error %v, expected not found", err)
+	}
+	assertJobStat(t, id, "state", "ready")
+}
+
+// TestPool demonstrates brokers sharing a single pooled connection.
+func TestPool(t *testing.T) {
+	pool := NewPool(address, 1)
+	defer pool.Close()
+
+	tube, _ := queueJob("hello world", 10, defaultTtr)
+	for i := uint64(0); i < 2; i++ {
+		b, err := NewWithOptions(Options{Pool: pool, Tube: tube, Slot: i, Cmd: "true", Concurrency: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Put(tube, []byte("another"), 20, 0, defaultTtr); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := b.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ready := stats.Tubes[tube].Ready; ready != i+2 {
+			t.Fatalf("%d jobs ready, expected %d", ready, i+2)
+		}
+	}
+	if len(pool.open) != 1 {
+		t.Fatalf("%d connections open, expected 1", len(pool.open))
+	}
+}
+
+// TestTLS demonstrates connecting and reconnecting over TLS, and a failed
+// handshake being reported as a dial error.
+func TestTLS(t *testing.T) {
+	addr, config, handshakes := tlsServer(t)
+	ctx := context.Background()
+
+	b := New(addr, "default", 0, "true", nil)
+	b.TLSConfig = config
+	if err := b.connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := waitCount(handshakes, 1); n != 1 {
+		t.Fatalf("%d handshakes on connect, expected 1", n)
+	}
+	if err := b.reconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := waitCount(handshakes, 2); n != 2 {
+		t.Fatalf("%d handshakes after reconnect, expected 2", n)
+	}
+	b.disconnect()
+
+	untrusted := New(addr, "default", 0, "true", nil)
+	untrusted.TLSConfig = &tls.Config{}
+	untrusted.ReconnectTries = 1
+	err := untrusted.connect(ctx)
+	var authErr x509.UnknownAuthorityError
+	if !errors.Is(err, ErrDial) || !errors.As(err, &authErr) {
+		t.Fatalf("connect error %v, expected an unknown authority dial error", err)
+	}
+	if n := handshakes.Load(); n != 2 {
+		t.Fatalf("%d handshakes completed, expected the untrusted one to fail", n)
+	}
+}
+
+// TestPoolDialsLikeBroker demonstrates pooled connections being dialed with
+// the broker's TLSConfig and ConnectHook.
+func TestPoolDialsLikeBroker(t *testing.T) {
+	addr, config, handshakes := tlsServer(t)
+	pool := NewPool(addr, 1)
+	defer pool.Close()
+
+	var hooked int
+	b := New(addr, "default", 0, "true", nil)
+	b.Pool = pool
+	b.TLSConfig = config
+	b.ConnectHook = func(conn *beanstalk.Conn) error {
+		hooked++
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := b.Put("default", []byte("hello"), 10, 0, defaultTtr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := waitCount(handshakes, 1); n != 1 || hooked != 1 {
+		t.Fatalf("%d handshakes and %d hook calls, expected 1 of each", n, hooked)
+	}
+}
+
+// TestConcurrency demonstrates jobs executing in parallel.
+func TestConcurrency(t *testing.T) {
+	tube, _ := queueJob("one", 10, defaultTtr)
+	putJob(tube, "two", 10, defaultTtr)
+
+	cmd := "sleep 2"
 	results := make(chan *JobResult)
 	b := New(address, tube, 0, cmd, results)
+	b.Concurrency = 2
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+
+	start := time.Now()
+	ticks <- true
+	ticks <- true
+	<-results
+	<-results
+	duration := time.Since(start)
+
+	if duration > 3*time.Second {
+		t.Fatalf("%v too long for jobs to have run concurrently", duration)
+	}
+}
+
+// TestOrdering demonstrates a single worker handling jobs strictly in
+// reserve order, each reaching its terminal operation before the next is
+// reserved.
+func TestOrdering(t *testing.T) {
+	tube, id1 := queueJob("one", 10, defaultTtr)
+	id2 := putJob(tube, "two", 10, defaultTtr)
+	id3 := putJob(tube, "three", 10, defaultTtr)
+
+	results := make(chan *JobResult, 3)
+	b := New(address, tube, 0, "cat", results)
+
+	var events []string
+	b.OnEvent = func(ev Event) {
+		if ev.Phase == PhaseReserve || ev.Phase == PhaseDelete {
+			events = append(events, fmt.Sprintf("%s %d", ev.Phase, ev.JobId))
+		}
+	}
+
+	ticks := make(chan bool)
+	go b.Run(ticks)
+	for i := 0; i < 3; i++ {
+		ticks <- true
+	}
+	for _, id := range []uint64{id1, id2, id3} {
+		if result := <-results; result.JobId != id {
+			t.Fatalf("result for job %d, expected %d", result.JobId, id)
+		}
+	}
+	close(ticks)
+
+	var expect []string
+	for _, id := range []uint64{id1, id2, id3} {
+		expect = append(expect, fmt.Sprintf("%s %d", PhaseReserve, id), fmt.Sprintf("%s %d", PhaseDelete, id))
+	}
+	if strings.Join(events, ", ") != strings.Join(expect, ", ") {
+		t.Fatalf("events %v, expected %v", events, expect)
+	}
+}
+
+// TestAsyncDeletes checks that queued deletes are finished by the time Run
+// returns.
+func TestAsyncDeletes(t *testing.T) {
+	tube, _ := queueJob("one", 10, defaultTtr)
+	putJob(tube, "two", 10, defaultTtr)
+	putJob(tube, "three", 10, defaultTtr)
+
+	results := make(chan *JobResult, 3)
+	b := New(address, tube, 0, "cat", results)
+	b.AsyncDeletes = 2
+
+	deleted := 0
+	b.OnEvent = func(ev Event) {
+		if ev.Phase == PhaseDelete {
+			deleted++
+		}
+	}
+
+	ticks := make(chan bool)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Run(ticks)
+	}()
+	for i := 0; i < 3; i++ {
+		ticks <- true
+		<-results
+	}
+	close(ticks)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted != 3 {
+		t.Fatalf("%d jobs deleted, expected 3", deleted)
+	}
+	assertTubeEmpty(tube)
+}
+
+// TestOnResult demonstrates OnResult being called as well as results being
+// sent to the channel.
+func TestOnResult(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "cat", results)
+	called := make(chan *JobResult, 1)
+	b.OnResult = func(result *JobResult) {
+		called <- result
+	}
 
 	ticks := make(chan bool)
 	defer close(ticks)
@@ -59,55 +2379,545 @@ func TestWorkerFailure(t *testing.T) {
 	ticks <- true // handle a single job
 
 	result := <-results
+	if got := <-called; got != result || got.JobId != id {
+		t.Fatalf("OnResult got %+v, expected result for job %d", got, id)
+	}
+}
 
-	if result.JobId != id {
-		t.Fatalf("result.JobId %d != queueJob id %d", result.JobId, id)
+// TestRecentResults demonstrates the latest results being kept, oldest
+// first.
+func TestRecentResults(t *testing.T) {
+	tube, _ := queueJob("exit 0", 10, defaultTtr)
+	id2 := putJob(tube, "exit 1", 10, defaultTtr)
+	id3 := putJob(tube, "exit 2", 10, defaultTtr)
+
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, "sh", results)
+	b.RecentResultsSize = 2
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	for i := 0; i < 3; i++ {
+		ticks <- true
+		<-results
 	}
 
-	if result.ExitStatus != 1 {
-		t.Fatalf("result.ExitStatus %d, expected 1", result.ExitStatus)
+	recent := b.RecentResults()
+	if len(recent) != 2 {
+		t.Fatalf("%d recent results, expected 2", len(recent))
 	}
+	if recent[0].JobId != id2 || recent[0].ExitStatus != 1 ||
+		recent[1].JobId != id3 || recent[1].ExitStatus != 2 {
+		t.Fatalf("unexpected recent results %+v", recent)
+	}
+}
 
-	assertJobStat(t, id, "state", "ready")
-	assertJobStat(t, id, "releases", "1")
-	assertJobStat(t, id, "pri", "10")
+// TestRecentResultsRing checks the ring buffer's wrapping.
+func TestRecentResultsRing(t *testing.T) {
+	var r recentResults
+	if got := r.list(); len(got) != 0 {
+		t.Fatalf("expected no results, got %+v", got)
+	}
+	for id := uint64(1); id <= 5; id++ {
+		r.add(&JobResult{JobId: id}, 3)
+	}
+	var ids []uint64
+	for _, result := range r.list() {
+		ids = append(ids, result.JobId)
+	}
+	if fmt.Sprint(ids) != "[3 4 5]" {
+		t.Fatalf("ids %v, expected [3 4 5]", ids)
+	}
 }
 
-func TestWorkerTimeout(t *testing.T) {
-	ttr := 1 * time.Second
-	tube, id := queueJob("TestWorkerTimeout", 10, ttr)
+// TestConnections checks that extra connections don't raise the number of
+// jobs executing at once above Concurrency.
+func TestConnections(t *testing.T) {
+	tube, _ := queueJob("one", 10, defaultTtr)
+	putJob(tube, "two", 10, defaultTtr)
 
-	cmd := "sleep 4"
+	cmd := "sleep 1"
 	results := make(chan *JobResult)
 	b := New(address, tube, 0, cmd, results)
+	b.Connections = 2
 
 	ticks := make(chan bool)
 	defer close(ticks)
 	go b.Run(ticks)
 
 	start := time.Now()
-	ticks <- true // handle a single job
-	result := <-results
+	ticks <- true
+	ticks <- true
+	<-results
+	<-results
 	duration := time.Since(start)
 
-	if duration < 1*time.Second {
-		t.Fatalf("%v too short to have timed out correctly", duration)
+	if duration < 2*time.Second {
+		t.Fatalf("%v too short for jobs to have run one at a time", duration)
+	}
+}
+
+// TestLimiter checks that brokers sharing a Limiter execute one job at a
+// time between them.
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(1)
+	results := make(chan *JobResult)
+	var allTicks []chan bool
+	for _, body := range []string{"one", "two"} {
+		tube, _ := queueJob(body, 10, defaultTtr)
+		b := New(address, tube, 0, "sleep 1", results)
+		b.Limiter = limiter
+
+		ticks := make(chan bool)
+		defer close(ticks)
+		go b.Run(ticks)
+		allTicks = append(allTicks, ticks)
 	}
 
-	if !result.TimedOut {
-		t.Fatalf("Expected job %d JobResult.TimedOut to be true", id)
+	start := time.Now()
+	for _, ticks := range allTicks {
+		ticks <- true
+	}
+	<-results
+	<-results
+	duration := time.Since(start)
+
+	if duration < 2*time.Second {
+		t.Fatalf("%v too short for jobs to have run one at a time", duration)
+	}
+	if n := limiter.InUse(); n != 0 {
+		t.Fatalf("%d limiter slots still in use", n)
+	}
+}
+
+// TestActionFor demonstrates a custom exit status mapping.
+func TestActionFor(t *testing.T) {
+	tube, id := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "exit 3"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.ActionFor = func(exitStatus int) Action {
+		if exitStatus == 3 {
+			return Release
+		}
+		return DefaultActionFor(exitStatus)
+	}
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+
+	if result.Buried {
+		t.Fatalf("Expected job %d not to be buried", id)
 	}
 
 	assertJobStat(t, id, "state", "ready")
-	assertJobStat(t, id, "timeouts", "1")
+	assertJobStat(t, id, "releases", "1")
+}
 
-	ticks <- true // handle another job
-	result = <-results
-	if !result.Buried {
-		t.Fatalf("Expected job %d JobResult.Buried", id)
+func TestReserveTimeoutTTRFactor(t *testing.T) {
+	tube, _ := queueJob("hello world", 10, 4*time.Second)
+
+	b := New(address, tube, 0, "true", nil)
+	b.ReserveTimeoutTTRFactor = 1.5
+	if err := b.connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer b.disconnect()
+
+	if d := b.ttrReserveTimeout(); d != 6*time.Second {
+		t.Fatalf("ttrReserveTimeout() = %v, expected %v", d, 6*time.Second)
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	b, err := NewWithOptions(Options{
+		Address:     address,
+		Tubes:       []string{"a", "b"},
+		Cmd:         "true",
+		Concurrency: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Concurrency != 2 || len(b.Tubes) != 2 || b.Cmd != "true" {
+		t.Fatalf("options not applied: %+v", b)
+	}
+
+	invalid := []Options{
+		{Tube: "a", Cmd: "true", Concurrency: 1},
+		{Address: address, Cmd: "true", Concurrency: 1},
+		{Address: address, Tube: "a", Concurrency: 1},
+		{Address: address, Tube: "a", Cmd: "true", Command: []string{"true"}, Concurrency: 1},
+		{Address: address, Tube: "a", Cmd: "true"},
+		{Address: address, Tube: "a", Cmd: "true", Concurrency: -1},
+		{Address: address, Tube: "a", Cmd: "true", Concurrency: 1, JobTimeout: -time.Second},
+		{Address: address, Tube: "a", Cmd: "true", Concurrency: 1, ShellArgs: []string{"-l"}},
+		{Address: "localhost:11301", Tube: "a", Cmd: "true", Concurrency: 1, Pool: NewPool(address, 1)},
+	}
+	for _, opts := range invalid {
+		if _, err := NewWithOptions(opts); err == nil {
+			t.Fatalf("expected an error for %+v", opts)
+		}
+	}
+}
+
+// TestNewWithOptionsNoShell demonstrates NewWithOptions reporting that Cmd
+// can't be run for want of a shell, unless ShellPath is given.
+func TestNewWithOptionsNoShell(t *testing.T) {
+	opts := Options{Address: address, Tube: "a", Cmd: "true", Concurrency: 1}
+	b, _ := newWithOptions(opts)
+	b.ShellPath, b.shellErr = "", errors.New("no shell found")
+	if err := validateOptions(opts, b); err == nil || !strings.Contains(err.Error(), "no shell found") {
+		t.Fatalf("expected the missing shell to be reported, got %v", err)
+	}
+
+	opts.ShellPath = "/bin/sh"
+	b, _ = newWithOptions(opts)
+	b.shellErr = errors.New("no shell found")
+	if err := validateOptions(opts, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOptionsLogger demonstrates the broker logging to Options.Logger's
+// output without changing its prefix.
+func TestOptionsLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "app: ", 0)
+	b, err := NewWithOptions(Options{
+		Address:     address,
+		Tubes:       []string{"a", "b"},
+		Cmd:         "true",
+		Concurrency: 1,
+		Logger:      logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.configureLog()
+	b.logf("hello")
+
+	if logger.Prefix() != "app: " {
+		t.Fatalf("Logger prefix changed to %q", logger.Prefix())
+	}
+	if expect := "[a,b:0] hello\n"; buf.String() != expect {
+		t.Fatalf("logged %q, expected %q", buf.String(), expect)
+	}
+}
+
+func TestArgv(t *testing.T) {
+	b := New(address, "default", 0, "tr a-z A-Z", nil)
+	if b.ShellPath == "" {
+		t.Fatal("ShellPath not set by New")
+	}
+
+	b.ShellPath = "/usr/local/bin/bash"
+	assertArgv(t, b.argv(b.Cmd), "/usr/local/bin/bash", "-c", "tr a-z A-Z")
+
+	b.ShellPath = ""
+	assertArgv(t, b.argv(b.Cmd), "/bin/bash", "-c", "tr a-z A-Z")
+
+	b.ShellArgs = []string{"-l", "-c"}
+	assertArgv(t, b.argv(b.Cmd), "/bin/bash", "-l", "-c", "tr a-z A-Z")
+
+	b.Shell = []string{"/bin/sh", "-c"}
+	assertArgv(t, b.argv(b.Cmd), "/bin/sh", "-c", "tr a-z A-Z")
+
+	b.ShellDisabled = true
+	assertArgv(t, b.argv(b.Cmd), "tr", "a-z", "A-Z")
+
+	b.Command = []string{"tr", "a-z A-Z", "x"}
+	assertArgv(t, b.argv(b.Cmd), "tr", "a-z A-Z", "x")
+
+	b.LimitCPU = 1500 * time.Millisecond
+	b.LimitMemory = 1 << 20
+	assertArgv(t, b.argv(b.Cmd), "/bin/sh", "-c", `ulimit -t 2 && ulimit -v 1024 && exec "$@"`, "cmdstalk", "tr", "a-z A-Z", "x")
+}
+
+func TestReleaseDelay(t *testing.T) {
+	b := New(address, "default", 0, "true", nil)
+	if d := b.releaseDelay(10); d != 10000*time.Second {
+		t.Fatalf("releaseDelay(10) = %v, expected %v", d, 10000*time.Second)
+	}
+
+	b.ReleaseBackoff = 100 * time.Millisecond
+	if d := b.releaseDelay(2); d != 1600*time.Millisecond {
+		t.Fatalf("releaseDelay(2) = %v, expected %v", d, 1600*time.Millisecond)
+	}
+
+	b.ReleaseBackoffMax = 1 * time.Second
+	if d := b.releaseDelay(2); d != 1*time.Second {
+		t.Fatalf("releaseDelay(2) = %v, expected %v", d, 1*time.Second)
+	}
+
+	b.ReleaseDelay = 5 * time.Second
+	if d := b.releaseDelay(0); d != 5*time.Second {
+		t.Fatalf("releaseDelay(0) = %v, expected %v", d, 5*time.Second)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	b := New(address, "default", 0, "true", nil)
+	d := 10 * time.Second
+
+	cases := []struct {
+		jitter float64
+		min    time.Duration
+	}{
+		{0, d},
+		{0.5, d / 2},
+		{1, 0},
+		{2, 0},
+	}
+	for _, c := range cases {
+		b.Jitter = c.jitter
+		for i := 0; i < 100; i++ {
+			if j := b.jitter(d); j < c.min || j > d {
+				t.Fatalf("jitter(%v) with Jitter %v = %v, expected %v to %v", d, c.jitter, j, c.min, d)
+			}
+		}
+	}
+
+	b.Jitter = 1
+	b.ReleaseDelay = 5 * time.Second
+	if d := b.releaseDelay(0); d != 5*time.Second {
+		t.Fatalf("releaseDelay(0) = %v, expected %v", d, 5*time.Second)
+	}
+}
+
+// TestReconnectPolicy demonstrates the reconnect backoff starting from the
+// delay for the class of failure.
+func TestReconnectPolicy(t *testing.T) {
+	clock := &fakeClock{}
+	b := New("127.0.0.1:1", "default", 0, "true", nil)
+	b.Clock = clock
+	b.ReconnectTries = 3
+	b.ReconnectPolicy = &ReconnectPolicy{Refused: 5 * time.Second, Transient: time.Second}
+
+	if err := b.connect(context.Background()); !errors.Is(err, ErrDial) {
+		t.Fatalf("expected ErrDial, got %v", err)
+	}
+	expect := []time.Duration{5 * time.Second, 10 * time.Second}
+	if fmt.Sprint(clock.afters) != fmt.Sprint(expect) {
+		t.Fatalf("waited %v, expected %v", clock.afters, expect)
+	}
+}
+
+func TestClassifyDialError(t *testing.T) {
+	cases := []struct {
+		err   error
+		class DialErrorClass
+	}{
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, DialRefused},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, DialTransient},
+		{io.EOF, DialTransient},
+		{os.ErrDeadlineExceeded, DialTransient},
+		{errors.New("connect hook: no"), DialOther},
+	}
+	for _, c := range cases {
+		if class := classifyDialError(c.err); class != c.class {
+			t.Errorf("classifyDialError(%v) = %v, expected %v", c.err, class, c.class)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	cases := []struct {
+		stdout string
+		delay  time.Duration
+		ok     bool
+	}{
+		{"retry-after: 30", 30 * time.Second, true},
+		{"working\nretry-after: 1m30s\n", 90 * time.Second, true},
+		{"retry-after: 5\nretry-after: 10", 10 * time.Second, true},
+		{"retry-after: soon", 0, false},
+		{"done", 0, false},
+	}
+	for _, c := range cases {
+		delay, ok := retryAfter([]byte(c.stdout))
+		if delay != c.delay || ok != c.ok {
+			t.Fatalf("retryAfter(%q) = %v, %v; expected %v, %v", c.stdout, delay, ok, c.delay, c.ok)
+		}
+	}
+}
+
+func TestAppendStdout(t *testing.T) {
+	b := New(address, "default", 0, "true", nil)
+	b.MaxStdoutBytes = 4
+
+	stdout := b.appendStdout(nil, []byte("ab"))
+	stdout = b.appendStdout(stdout, []byte("cdef"))
+	stdout = b.appendStdout(stdout, []byte("gh"))
+
+	if expect := []byte("abcd" + TruncatedMarker); !bytes.Equal(stdout, expect) {
+		t.Fatalf("stdout %q, expected %q", stdout, expect)
+	}
+}
+
+func TestTakeStdoutBudget(t *testing.T) {
+	b := New(address, "default", 0, "true", nil)
+	b.MaxTotalStdoutBytes = 10
+
+	if n := b.takeStdoutBudget(6); n != 6 {
+		t.Fatalf("takeStdoutBudget(6) = %d, expected 6", n)
+	}
+	if n := b.takeStdoutBudget(6); n != 4 {
+		t.Fatalf("takeStdoutBudget(6) = %d, expected 4", n)
+	}
+	if n := b.shared.discardedStdout.Load(); n != 2 {
+		t.Fatalf("discarded %d, expected 2", n)
+	}
+
+	b.shared.stdoutBytes.Add(-6) // a job finished
+	if n := b.takeStdoutBudget(8); n != 6 {
+		t.Fatalf("takeStdoutBudget(8) = %d, expected 6", n)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	b := New(address, "default", 0, "true", nil)
+	b.ActionRetries = 2
+	b.ActionRetryDelay = time.Millisecond
+	job := bs.Job{Id: 1}
+
+	calls := 0
+	err := b.retry(job, Delete, func() error {
+		if calls++; calls < 3 {
+			return beanstalk.ConnError{Op: "delete", Err: beanstalk.ErrOOM}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("retry returned %v after %d calls, expected success after 3", err, calls)
+	}
+
+	calls = 0
+	err = b.retry(job, Delete, func() error {
+		calls++
+		return beanstalk.ConnError{Op: "delete", Err: beanstalk.ErrNotFound}
+	})
+	var actionErr *actionError
+	if !errors.As(err, &actionErr) || calls != 1 {
+		t.Fatalf("retry returned %v after %d calls, expected actionError after 1", err, calls)
+	}
+}
+
+// fakeClock records sleeps instead of sleeping, and fires After at once.
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+	afters []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.afters = append(c.afters, d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now.Add(d)
+	return ch
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	clock := &fakeClock{}
+	b := New(address, "default", 0, "true", nil)
+	b.Clock = clock
+	b.ActionRetries = 3
+
+	b.retry(bs.Job{Id: 1}, Release, func() error {
+		return beanstalk.ConnError{Op: "release", Err: beanstalk.ErrInternal}
+	})
+
+	expect := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}
+	if len(clock.sleeps) != len(expect) {
+		t.Fatalf("slept %v, expected %v", clock.sleeps, expect)
+	}
+	for i, d := range expect {
+		if clock.sleeps[i] != d {
+			t.Fatalf("slept %v, expected %v", clock.sleeps, expect)
+		}
+	}
+}
+
+func TestRate(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	b := New(address, "default", 0, "true", nil)
+	b.Clock = clock
+	b.RateWindow = 10 * time.Second
+
+	for i := 0; i < 20; i++ {
+		b.recordRate(&JobResult{Executed: true, ExitStatus: i % 4})
+		clock.Sleep(250 * time.Millisecond)
+	}
+	b.recordRate(&JobResult{}) // not executed
+
+	rate, ratio := b.Rate()
+	if rate != 2 || ratio != 0.25 {
+		t.Fatalf("Rate() = %v, %v, expected 2, 0.25", rate, ratio)
+	}
+
+	clock.Sleep(time.Minute)
+	if rate, ratio := b.Rate(); rate != 0 || ratio != 0 {
+		t.Fatalf("Rate() = %v, %v after window, expected 0, 0", rate, ratio)
+	}
+
+	// Buckets outside the window are dropped even if Rate isn't called.
+	for i := 0; i < 100; i++ {
+		b.recordRate(&JobResult{Executed: true})
+		clock.Sleep(time.Second)
+	}
+	if n := len(b.shared.rate.buckets); n > 10 {
+		t.Fatalf("%d buckets held, expected at most 10 for a 10s window", n)
+	}
+}
+
+func TestResultWriter(t *testing.T) {
+	var buf bytes.Buffer
+	rw := newResultWriter(&buf, t.Logf)
+	rw.write(&JobResult{JobId: 1, Stdout: []byte("out"), IntendedAction: Release, Error: errors.New("oops")})
+	rw.write(&JobResult{JobId: 2, Err: errors.New("exec failed"), Stats: map[string]string{"pri": "10"}})
+	rw.close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines written, expected 2: %q", len(lines), buf.String())
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["JobId"] != 1.0 || decoded["Stdout"] != "out" || decoded["IntendedAction"] != "release" || decoded["Error"] != "oops" {
+		t.Fatalf("unexpected result line %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"Err":"exec failed"`) || !strings.Contains(lines[1], `"Stats":{"pri":"10"}`) {
+		t.Fatalf("unexpected result line %s", lines[1])
+	}
+}
+
+func TestLogOutput(t *testing.T) {
+	var buf bytes.Buffer
+	flags := 0
+	b := New(address, "default", 0, "true", nil)
+	b.LogOutput = &buf
+	b.LogFlags = &flags
+	b.LogPrefix = "worker: "
+	b.configureLog()
+
+	b.logf("hello %s", "world")
+	if expect := "worker: hello world\n"; buf.String() != expect {
+		t.Fatalf("logged %q, expected %q", buf.String(), expect)
 	}
-	assertJobStat(t, id, "state", "buried")
-	assertJobStat(t, id, "timeouts", "1")
 }
 
 func queueJob(body string, priority uint32, ttr time.Duration) (string, uint64) {
@@ -115,6 +2925,10 @@ func queueJob(body string, priority uint32, ttr time.Duration) (string, uint64)
 	tubeName := "cmdstalk-test-" + strconv.FormatInt(r.Int63(), 16)
 	assertTubeEmpty(tubeName)
 
+	return tubeName, putJob(tubeName, body, priority, ttr)
+}
+
+func putJob(tubeName, body string, priority uint32, ttr time.Duration) uint64 {
 	c, err := beanstalk.Dial("tcp", address)
 	if err != nil {
 		log.Fatal(err)
@@ -127,13 +2941,92 @@ func queueJob(body string, priority uint32, ttr time.Duration) (string, uint64)
 		log.Fatal(err)
 	}
 
-	return tubeName, id
+	return id
 }
 
 func assertTubeEmpty(tubeName string) {
 	// TODO
 }
 
+// tlsServer listens for TLS connections with a self-signed certificate for
+// 127.0.0.1, answering put and use as beanstalkd would. It returns its
+// address, a client config trusting it, and a count of handshakes completed.
+func tlsServer(t *testing.T) (string, *tls.Config, *atomic.Int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "cmdstalk test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	handshakes := new(atomic.Int64)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if conn.(*tls.Conn).Handshake() != nil {
+					return
+				}
+				handshakes.Add(1)
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch fields := strings.Fields(line); fields[0] {
+					case "use":
+						fmt.Fprintf(conn, "USING %s\r\n", fields[1])
+					case "put":
+						r.ReadString('\n')
+						fmt.Fprint(conn, "INSERTED 1\r\n")
+					default:
+						fmt.Fprint(conn, "UNKNOWN_COMMAND\r\n")
+					}
+				}
+			}()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return l.Addr().String(), &tls.Config{RootCAs: roots}, handshakes
+}
+
+// waitCount waits up to a second for c to reach n, as a server records a
+// handshake just after the client has completed it, returning its value.
+func waitCount(c *atomic.Int64, n int64) int64 {
+	for deadline := time.Now().Add(time.Second); c.Load() < n && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	return c.Load()
+}
+
 func assertJobStat(t *testing.T, id uint64, key, value string) {
 	c, err := beanstalk.Dial("tcp", address)
 	if err != nil {
@@ -147,3 +3040,14 @@ func assertJobStat(t *testing.T, id uint64, key, value string) {
 		t.Fatalf("job %d %s = %s, expected %s", id, key, stats[key], value)
 	}
 }
+
+func assertArgv(t *testing.T, argv []string, expect ...string) {
+	if len(argv) != len(expect) {
+		t.Fatalf("argv %q, expected %q", argv, expect)
+	}
+	for i := range argv {
+		if argv[i] != expect[i] {
+			t.Fatalf("argv %q, expected %q", argv, expect)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+//go:build unix
+
+package broker
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/99designs/cmdstalk/bs"
+)
+
+// TestRunWithSignals demonstrates SIGTERM stopping the broker once the job
+// in flight has finished, and the default handling being restored after.
+func TestRunWithSignals(t *testing.T) {
+	fake := bs.NewFake()
+	id, _ := fake.Conn().Put("signals", []byte("hello"), 10, 0, defaultTtr)
+
+	results := make(chan *JobResult, 1)
+	b := New("", "signals", 0, "sleep 0.5; echo -n done", results)
+	b.Dial = func() (bs.Conn, error) { return fake.Conn(), nil }
+	started := make(chan struct{})
+	b.OnEvent = func(ev Event) {
+		if ev.Phase == PhaseStart {
+			close(started)
+		}
+	}
+
+	done := make(chan error)
+	go func() { done <- b.RunWithSignals(nil) }()
+	<-started
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunWithSignals didn't return after SIGTERM")
+	}
+
+	result := <-results
+	if result.JobId != id || string(result.Stdout) != "done" || result.ExitStatus != 0 {
+		t.Fatalf("expected the job to finish, got %+v", result)
+	}
+	if _, err := fake.Conn().StatsJob(id); !bs.NotFound(err) {
+		t.Fatalf("expected job %d to be deleted, got %v", id, err)
+	}
+	if signal.Ignored(syscall.SIGTERM) {
+		t.Fatal("SIGTERM left ignored")
+	}
+}
+
+// TestJobTimeoutKillsChildren demonstrates a worker's children being killed
+// along with it, as they share its process group.
+func TestJobTimeoutKillsChildren(t *testing.T) {
+	tube, _ := queueJob("hello world", 10, defaultTtr)
+
+	cmd := "sleep 30 & echo -n $!; wait"
+	results := make(chan *JobResult)
+	b := New(address, tube, 0, cmd, results)
+	b.JobTimeout = 500 * time.Millisecond
+
+	ticks := make(chan bool)
+	defer close(ticks)
+	go b.Run(ticks)
+	ticks <- true // handle a single job
+
+	result := <-results
+	if !result.JobTimedOut {
+		t.Fatalf("expected job timeout, got %+v", result)
+	}
+	child, err := strconv.Atoi(string(result.Stdout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; processRunning(child); i++ {
+		if i == 10 {
+			t.Fatalf("child %d still running", child)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// processRunning reports whether pid exists and isn't a zombie.
+func processRunning(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil {
+		return false
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true // not Linux; assume the worst
+	}
+	_, after, _ := strings.Cut(string(stat), ") ")
+	return !strings.HasPrefix(after, "Z")
+}
@@ -0,0 +1,46 @@
+package broker
+
+// CancelJob kills the command executing the job with id, if this broker is
+// running it, and releases the job. It reports whether the job was found.
+// It is safe to call concurrently with Run.
+func (b *Broker) CancelJob(id uint64) bool {
+	b.shared.mu.Lock()
+	defer b.shared.mu.Unlock()
+	cancel, ok := b.shared.running[id]
+	if ok {
+		close(cancel)
+		delete(b.shared.running, id)
+	}
+	return ok
+}
+
+// cancelAll cancels every running job, returning how many there were.
+func (b *Broker) cancelAll() int {
+	b.shared.mu.Lock()
+	defer b.shared.mu.Unlock()
+	n := len(b.shared.running)
+	for id, cancel := range b.shared.running {
+		close(cancel)
+		delete(b.shared.running, id)
+	}
+	return n
+}
+
+// register the job as running, returning a channel closed by CancelJob.
+func (b *Broker) register(id uint64) <-chan struct{} {
+	b.shared.mu.Lock()
+	defer b.shared.mu.Unlock()
+	if b.shared.running == nil {
+		b.shared.running = make(map[uint64]chan struct{})
+	}
+	cancel := make(chan struct{})
+	b.shared.running[id] = cancel
+	return cancel
+}
+
+// unregister the job once it is no longer running.
+func (b *Broker) unregister(id uint64) {
+	b.shared.mu.Lock()
+	defer b.shared.mu.Unlock()
+	delete(b.shared.running, id)
+}
@@ -0,0 +1,26 @@
+package broker
+
+import "time"
+
+// Clock is the source of time for a Broker's timeouts, delays and
+// timestamps, replaceable in tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// realClock is the Clock used when Broker.Clock is nil.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+// clock returns Clock, or the real clock if it is nil.
+func (b *Broker) clock() Clock {
+	if b.Clock == nil {
+		return realClock{}
+	}
+	return b.Clock
+}
@@ -0,0 +1,41 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// cmdTemplateData is what CmdTemplate is rendered with.
+type cmdTemplateData struct {
+	JobId    uint64
+	Tube     string
+	Priority uint32
+	Stats    map[string]string
+}
+
+// parseCmdTemplate parses CmdTemplate, with its functions.
+func parseCmdTemplate(text string) (*template.Template, error) {
+	t, err := template.New("cmd").Funcs(template.FuncMap{"quote": shellQuote}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("cmd template: %w", err)
+	}
+	return t.Option("missingkey=error"), nil
+}
+
+// renderCmd renders t for the job described by info.
+func renderCmd(t *template.Template, info JobInfo) (string, error) {
+	var sb strings.Builder
+	err := t.Execute(&sb, cmdTemplateData{
+		JobId:    info.Id,
+		Tube:     info.Tube,
+		Priority: info.Priority,
+		Stats:    info.Stats,
+	})
+	return sb.String(), err
+}
+
+// shellQuote quotes v as a single shell word.
+func shellQuote(v interface{}) string {
+	return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", `'\''`) + "'"
+}
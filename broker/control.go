@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/99designs/cmdstalk/bs"
+	"github.com/kr/beanstalk"
+)
+
+// controlConn is a lazily dialed connection to beanstalkd for requests made
+// outside the run loop, e.g. by Stats. The run loop's own connections can't
+// be used, as they spend most of their time blocked in reserve.
+type controlConn struct {
+	mu   sync.Mutex
+	conn *beanstalk.Conn
+}
+
+// withControlConn calls f with the control connection, dialing it first if
+// needed. Calls are serialized. The connection is discarded if f returns an
+// error indicating it was lost, to be redialed on the next call.
+// With Pool set, a pooled connection is used instead, dialed the same way.
+func (b *Broker) withControlConn(f func(conn *beanstalk.Conn) error) error {
+	if b.Pool != nil {
+		return b.Pool.with(b.dial, f)
+	}
+
+	c := &b.shared.control
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		conn, err := b.dial()
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+
+	err := f(c.conn)
+	if bs.ConnectionLost(err) {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// Put a job into the named tube, returning its id. It is safe to call
+// concurrently with Run.
+func (b *Broker) Put(tube string, body []byte, pri uint32, delay, ttr time.Duration) (id uint64, err error) {
+	err = b.withControlConn(func(conn *beanstalk.Conn) error {
+		t := beanstalk.Tube{Conn: conn, Name: tube}
+		id, err = t.Put(body, pri, delay, ttr)
+		return err
+	})
+	return
+}
+
+// Kick moves up to n buried jobs back to the ready queue, returning how many
+// were kicked. With several tubes, each is kicked in turn until n is reached.
+// It is safe to call concurrently with Run.
+func (b *Broker) Kick(n int) (kicked int, err error) {
+	err = b.withControlConn(func(conn *beanstalk.Conn) error {
+		for _, name := range b.tubes() {
+			if kicked >= n {
+				break
+			}
+			t := beanstalk.Tube{Conn: conn, Name: name}
+			k, err := t.Kick(n - kicked)
+			if err != nil {
+				return err
+			}
+			kicked += k
+		}
+		return nil
+	})
+	return
+}
+
+// PeekReady returns the next ready job, from the first of the broker's tubes
+// which has one, without reserving it. If there are none the error satisfies
+// bs.NotFound. It is safe to call concurrently with Run.
+func (b *Broker) PeekReady() (id uint64, body []byte, err error) {
+	return b.peek((*beanstalk.Tube).PeekReady)
+}
+
+// PeekDelayed is like PeekReady, for the delayed job with the shortest
+// delay left.
+func (b *Broker) PeekDelayed() (id uint64, body []byte, err error) {
+	return b.peek((*beanstalk.Tube).PeekDelayed)
+}
+
+// PeekBuried is like PeekReady, for the next job to be kicked.
+func (b *Broker) PeekBuried() (id uint64, body []byte, err error) {
+	return b.peek((*beanstalk.Tube).PeekBuried)
+}
+
+// peek calls f for each of the broker's tubes until one has a job.
+func (b *Broker) peek(f func(t *beanstalk.Tube) (uint64, []byte, error)) (id uint64, body []byte, err error) {
+	err = b.withControlConn(func(conn *beanstalk.Conn) error {
+		var err error
+		for _, name := range b.tubes() {
+			id, body, err = f(&beanstalk.Tube{Conn: conn, Name: name})
+			if !bs.NotFound(err) {
+				return err
+			}
+		}
+		return err
+	})
+	return
+}
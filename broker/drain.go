@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/99designs/cmdstalk/bs"
+)
+
+// runState is a RunContext in progress, for Drain.
+type runState struct {
+	stop context.CancelFunc
+	done chan struct{}
+
+	// cancellable is whether RunContext's caller can cancel it, in which
+	// case reserves wait at most ContextReserveTimeout by default.
+	cancellable bool
+
+	// reserving holds the connections of workers waiting in reserve, to be
+	// closed by Drain, which sets draining. Guarded by shared.mu.
+	reserving map[*Broker]bs.Conn
+	draining  bool
+}
+
+// Drain stops the broker reserving jobs, and waits up to timeout for jobs
+// in progress to finish and Run to return. Any still running after timeout
+// are killed and released, and an error is returned. Results must still be
+// received meanwhile. It returns nil at once if the broker isn't running,
+// and is safe to call concurrently with Run.
+func (b *Broker) Drain(timeout time.Duration) error {
+	b.shared.mu.Lock()
+	r := b.shared.run
+	b.shared.mu.Unlock()
+	if r == nil {
+		return nil
+	}
+
+	r.stop()
+	b.shared.mu.Lock()
+	r.draining = true
+	for _, conn := range r.reserving {
+		// Such a worker holds no job, so closing its connection only cuts
+		// short a reserve which may otherwise wait DefaultReserveTimeout.
+		conn.Close()
+	}
+	b.shared.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return nil
+	case <-b.clock().After(timeout):
+	}
+
+	killed := b.cancelAll()
+	<-r.done
+	return fmt.Errorf("drain timed out after %v, killed %d jobs", timeout, killed)
+}
+
+// startRun records a RunContext in progress with stop to cancel it,
+// returning a func to call when it returns.
+func (b *Broker) startRun(stop context.CancelFunc, cancellable bool) func() {
+	r := &runState{
+		stop:        stop,
+		done:        make(chan struct{}),
+		cancellable: cancellable,
+		reserving:   make(map[*Broker]bs.Conn),
+	}
+	b.shared.mu.Lock()
+	b.shared.run = r
+	b.shared.mu.Unlock()
+
+	return func() {
+		b.shared.mu.Lock()
+		b.shared.run = nil
+		b.shared.mu.Unlock()
+		stop()
+		close(r.done)
+	}
+}
+
+// defaultReserveTimeout is the reserve timeout if ReserveTimeout is zero:
+// ContextReserveTimeout if RunContext can be cancelled by its caller, or
+// else DefaultReserveTimeout, Drain closing the connection instead.
+func (b *Broker) defaultReserveTimeout() time.Duration {
+	b.shared.mu.Lock()
+	defer b.shared.mu.Unlock()
+	if r := b.shared.run; r == nil || !r.cancellable {
+		return DefaultReserveTimeout
+	}
+	return ContextReserveTimeout
+}
+
+// reserving records that the worker is about to wait in reserve, returning
+// a func to call once it is done, or false if Drain has been called. The
+// func reports whether Drain was called meanwhile, and so has closed the
+// connection.
+func (b *Broker) reserving() (func() bool, bool) {
+	b.shared.mu.Lock()
+	defer b.shared.mu.Unlock()
+	r := b.shared.run
+	if r == nil {
+		return func() bool { return false }, true
+	}
+	if r.draining {
+		return nil, false
+	}
+	r.reserving[b] = b.conn
+	return func() bool {
+		b.shared.mu.Lock()
+		defer b.shared.mu.Unlock()
+		delete(r.reserving, b)
+		return r.draining
+	}, true
+}
@@ -0,0 +1,109 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/99designs/cmdstalk/bs"
+)
+
+// dump reserves each ready job, writing its body to DumpDir, until none are
+// left, then releases them all unchanged. Holding them meanwhile is what
+// stops a released job being reserved and dumped again straight away.
+func (b *Broker) dump(ctx context.Context, ticks chan bool) error {
+	var held []bs.Job
+	defer func() { b.releaseDumped(held) }()
+
+	for {
+		if ticks != nil {
+			select {
+			case _, ok := <-ticks:
+				if !ok {
+					b.logf("broker finished")
+					return nil
+				}
+			case <-ctx.Done():
+				b.logf("broker cancelled")
+				return nil
+			}
+		}
+		if ctx.Err() != nil {
+			b.logf("broker cancelled")
+			return nil
+		}
+
+		if b.MaxJobs > 0 && b.shared.jobs.Add(1) > uint64(b.MaxJobs) {
+			b.logf("reached %d jobs, finishing", b.MaxJobs)
+			return nil
+		}
+
+		id, body, err := b.ts.Reserve(0)
+		if bs.DeadlineSoon(err) {
+			b.touchDumped(held)
+			continue
+		}
+		if bs.TimedOut(err) {
+			b.logf("dumped %d jobs, none left ready", len(held))
+			return nil
+		}
+		if err != nil {
+			b.setLastError(err)
+			return fmt.Errorf("%w: %w", ErrReserve, err)
+		}
+
+		job := bs.NewJob(id, body, b.conn)
+		held = append(held, job)
+		result, err := b.dumpJob(job)
+		if err != nil {
+			result.Error = err
+			b.setLastError(err)
+		}
+		b.sendResult(result)
+		if err != nil {
+			return &JobError{JobId: job.Id, Err: err}
+		}
+	}
+}
+
+// dumpJob writes the job's body to DumpDir/<tube>-<id>.
+func (b *Broker) dumpJob(job bs.Job) (*JobResult, error) {
+	result := &JobResult{JobId: job.Id, IntendedAction: Release}
+	tube, err := job.Tube()
+	if err != nil {
+		return result, err
+	}
+	result.Tube = tube
+
+	path := filepath.Join(b.DumpDir, fmt.Sprintf("%s-%d", tube, job.Id))
+	if err := os.WriteFile(path, job.Body, 0o644); err != nil {
+		return result, fmt.Errorf("dump: %w", err)
+	}
+	b.logEvent(logFields{"event": "dump", "job_id": job.Id, "path": path}, "job %d dumped to %s", job.Id, path)
+	return result, nil
+}
+
+// touchDumped touches the held jobs, which beanstalkd has reported are
+// about to time out.
+func (b *Broker) touchDumped(held []bs.Job) {
+	for _, job := range held {
+		if err := job.Touch(); err != nil && !bs.NotFound(err) {
+			b.logf("touching dumped job %d failed: %s", job.Id, err)
+		}
+	}
+}
+
+// releaseDumped releases the held jobs with their original priority and no
+// delay.
+func (b *Broker) releaseDumped(held []bs.Job) {
+	for _, job := range held {
+		pri, err := b.priority(job)
+		if err == nil {
+			err = job.ReleaseWithPriority(pri, 0)
+		}
+		if err != nil {
+			b.logf("releasing dumped job %d failed: %s", job.Id, err)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Categories of error returned by Run, or recorded in JobResult.Err, which
+// can be told apart with errors.Is. The underlying cause is wrapped too.
+var (
+	// ErrDial is connecting to beanstalkd failing ReconnectTries times.
+	ErrDial = errors.New("dial")
+
+	// ErrReserve is reserving a job failing other than by losing the
+	// connection, which is reconnected instead.
+	ErrReserve = errors.New("reserve")
+
+	// ErrCommandStart is the worker command failing to start, other than
+	// because it doesn't exist; see JobResult.CommandNotFound.
+	ErrCommandStart = errors.New("starting command")
+
+	// ErrTerminalOp is deleting, releasing or burying a job failing after
+	// any ActionRetries.
+	ErrTerminalOp = errors.New("terminal operation")
+)
+
+// JobError is an error handling a particular job.
+type JobError struct {
+	JobId uint64
+	Err   error
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("job %d: %s", e.JobId, e.Err)
+}
+
+func (e *JobError) Unwrap() error { return e.Err }
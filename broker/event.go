@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Phase of a job's lifecycle, as reported by an Event.
+type Phase int
+
+const (
+	// PhaseReserve is when a job has been reserved.
+	PhaseReserve Phase = iota
+
+	// PhaseStart is just before the worker command is started.
+	PhaseStart
+
+	// PhaseFinish is when the worker command has exited.
+	PhaseFinish
+
+	// PhaseDelete is when the job has been deleted.
+	PhaseDelete
+
+	// PhaseRelease is when the job has been released.
+	PhaseRelease
+
+	// PhaseBury is when the job has been buried.
+	PhaseBury
+
+	// PhaseSlow follows PhaseFinish if the command ran longer than
+	// Broker.SlowJobThreshold.
+	PhaseSlow
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseReserve:
+		return "reserve"
+	case PhaseStart:
+		return "start"
+	case PhaseFinish:
+		return "finish"
+	case PhaseDelete:
+		return "delete"
+	case PhaseRelease:
+		return "release"
+	case PhaseBury:
+		return "bury"
+	case PhaseSlow:
+		return "slow"
+	}
+	return fmt.Sprintf("Phase(%d)", int(p))
+}
+
+// Event is a job lifecycle transition, passed to Broker.OnEvent.
+type Event struct {
+	Phase Phase
+	JobId uint64
+	Tube  string
+
+	// ExitStatus of the worker command, from PhaseFinish onwards.
+	// Zero if the job was not executed.
+	ExitStatus int
+
+	// Time the transition happened.
+	Time time.Time
+
+	// Context of the job, from which JobInfoFromContext retrieves its
+	// details.
+	Context context.Context
+}
+
+// emit calls OnEvent, if set, with an Event for the job in result.
+func (b *Broker) emit(ctx context.Context, phase Phase, result *JobResult) {
+	if b.OnEvent == nil {
+		return
+	}
+	ev := Event{
+		Phase:      phase,
+		JobId:      result.JobId,
+		Tube:       result.Tube,
+		ExitStatus: result.ExitStatus,
+		Time:       b.clock().Now(),
+		Context:    ctx,
+	}
+	inHook("OnEvent", func() { b.OnEvent(ev) })
+}
+
+// checkSlow reports the job as slow if it ran longer than SlowJobThreshold.
+func (b *Broker) checkSlow(ctx context.Context, result *JobResult) {
+	if b.SlowJobThreshold <= 0 || result.Duration <= b.SlowJobThreshold {
+		return
+	}
+	incrSlow(b.metrics())
+	b.logEvent(logFields{
+		"event":        "slow",
+		"job_id":       result.JobId,
+		"duration_ms":  result.Duration.Milliseconds(),
+		"threshold_ms": b.SlowJobThreshold.Milliseconds(),
+	}, "job %d was slow: took %v, over SlowJobThreshold %v", result.JobId, result.Duration, b.SlowJobThreshold)
+	b.emit(ctx, PhaseSlow, result)
+}
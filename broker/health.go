@@ -0,0 +1,27 @@
+package broker
+
+import "time"
+
+// Healthy reports whether the broker is connected to beanstalkd and, if
+// HealthTimeout is set, has either completed a reserve within HealthTimeout
+// or is busy handling a job. It is safe to call concurrently with Run.
+func (b *Broker) Healthy() bool {
+	if b.shared.connected.Load() == 0 {
+		return false
+	}
+	if b.HealthTimeout == 0 || b.shared.busy.Load() > 0 {
+		return true
+	}
+	return b.clock().Now().Sub(b.LastReserveTime()) < b.HealthTimeout
+}
+
+// LastReserveTime is when a reserve last completed, with a job or by timing
+// out, or when the broker connected if no reserve has completed since.
+// It is the zero time if the broker has never connected.
+func (b *Broker) LastReserveTime() time.Time {
+	ns := b.shared.lastContact.Load()
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
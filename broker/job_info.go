@@ -0,0 +1,52 @@
+package broker
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/99designs/cmdstalk/bs"
+)
+
+// JobInfo describes a reserved job to hooks such as StdinBuilder, directly
+// or through a context.Context.
+type JobInfo struct {
+	Id       uint64
+	Tube     string
+	Priority uint32
+
+	// Stats holds stats-job for the job as of when it was reserved.
+	Stats map[string]string
+}
+
+// newJobInfo fetches stats-job for job.
+func newJobInfo(job bs.Job) (JobInfo, error) {
+	stats, err := job.Stats()
+	if err != nil {
+		return JobInfo{}, err
+	}
+	pri, _ := strconv.ParseUint(stats["pri"], 10, 32)
+	return JobInfo{
+		Id:       job.Id,
+		Tube:     stats["tube"],
+		Priority: uint32(pri),
+		Stats:    stats,
+	}, nil
+}
+
+// jobInfoKey is the context key for a *JobInfo.
+type jobInfoKey struct{}
+
+// withJobInfo returns a copy of ctx carrying info.
+func withJobInfo(ctx context.Context, info *JobInfo) context.Context {
+	return context.WithValue(ctx, jobInfoKey{}, info)
+}
+
+// JobInfoFromContext returns the JobInfo carried by ctx, such as
+// Event.Context, if any.
+func JobInfoFromContext(ctx context.Context) (*JobInfo, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	info, ok := ctx.Value(jobInfoKey{}).(*JobInfo)
+	return info, ok
+}
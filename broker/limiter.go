@@ -0,0 +1,35 @@
+package broker
+
+import "context"
+
+// Limiter caps the number of jobs executing at once across every Broker
+// sharing it, e.g. many tube brokers in one process, whatever their own
+// Concurrency.
+type Limiter struct {
+	slots chan struct{}
+}
+
+// NewLimiter returns a Limiter allowing n jobs to execute at once.
+func NewLimiter(n int) *Limiter {
+	return &Limiter{slots: make(chan struct{}, max(n, 1))}
+}
+
+// Acquire waits for a slot, returning ctx's error if it is cancelled first.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by Acquire.
+func (l *Limiter) Release() {
+	<-l.slots
+}
+
+// InUse is the number of slots currently taken.
+func (l *Limiter) InUse() int {
+	return len(l.slots)
+}
@@ -0,0 +1,31 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// limitShell applies ulimits before executing a command.
+const limitShell = "/bin/sh"
+
+// withLimits wraps argv in a shell which sets LimitCPU and LimitMemory with
+// ulimit, then execs argv in its place.
+func (b *Broker) withLimits(argv []string) []string {
+	var limits []string
+	if b.LimitCPU > 0 {
+		secs := (b.LimitCPU + time.Second - 1) / time.Second
+		limits = append(limits, fmt.Sprintf("ulimit -t %d", secs))
+	}
+	if b.LimitMemory > 0 {
+		kb := (b.LimitMemory + 1023) / 1024
+		limits = append(limits, fmt.Sprintf("ulimit -v %d", kb))
+	}
+	if len(limits) == 0 {
+		return argv
+	}
+
+	script := strings.Join(limits, " && ") + ` && exec "$@"`
+	wrapped := make([]string, 0, len(argv)+4)
+	return append(append(wrapped, limitShell, "-c", script, "cmdstalk"), argv...)
+}
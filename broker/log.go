@@ -0,0 +1,91 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/99designs/cmdstalk/bs"
+)
+
+// logFields are structured data describing a logged event, included when
+// Broker.JSONLogs is set.
+type logFields map[string]interface{}
+
+// configureLog applies LogOutput, LogFlags and LogPrefix to the logger
+// created by New. With JSONLogs the prefix and flags are cleared instead,
+// each line being a whole JSON object, but the logger is still shared so
+// that workers' lines are written one at a time.
+func (b *Broker) configureLog() {
+	if b.LogOutput != nil {
+		b.log.SetOutput(b.LogOutput)
+	}
+	if b.LogFlags != nil {
+		b.log.SetFlags(*b.LogFlags)
+	}
+	if b.LogPrefix != "" {
+		b.log.SetPrefix(b.LogPrefix)
+	} else if len(b.Tubes) > 0 {
+		b.log.SetPrefix(fmt.Sprintf("[%s:%d] ", strings.Join(b.Tubes, ","), b.slot))
+	}
+	if b.JSONLogs {
+		b.log.SetPrefix("")
+		b.log.SetFlags(0)
+	}
+}
+
+// logf logs a plain message.
+func (b *Broker) logf(format string, args ...interface{}) {
+	b.logEvent(nil, format, args...)
+}
+
+// logEvent logs a message which, in plain text mode, should itself describe
+// the event; fields are only written in JSON mode.
+func (b *Broker) logEvent(fields logFields, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !b.JSONLogs {
+		b.log.Print(msg)
+		return
+	}
+
+	ev := logFields{
+		"time": b.clock().Now().Format(time.RFC3339Nano),
+		"tube": strings.Join(b.tubes(), ","),
+		"slot": b.slot,
+		"msg":  msg,
+	}
+	for k, v := range fields {
+		ev[k] = v
+	}
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		b.log.Print(msg)
+		return
+	}
+	b.log.Print(string(line))
+}
+
+// actionFields describe an action taken on a job.
+func actionFields(job bs.Job, action Action) logFields {
+	return logFields{"event": "action", "action": action.String(), "job_id": job.Id}
+}
+
+// finishFields describe a job's worker exiting.
+func finishFields(result *JobResult) logFields {
+	fields := logFields{
+		"event":         "finish",
+		"job_id":        result.JobId,
+		"exit_status":   result.ExitStatus,
+		"signal":        int(result.Signal),
+		"timed_out":     result.TimedOut,
+		"job_timed_out": result.JobTimedOut,
+		"stalled_io":    result.StalledIO,
+		"duration_ms":   result.Duration.Milliseconds(),
+	}
+	if result.Err != nil {
+		fields["error"] = result.Err.Error()
+	}
+	return fields
+}
@@ -0,0 +1,97 @@
+package broker
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives counts of job outcomes and timings from a Broker.
+// Implementations must be safe for concurrent use, as a Broker with
+// Concurrency > 1 calls them from multiple goroutines.
+type Metrics interface {
+
+	// IncrDeleted is called when a job is deleted.
+	IncrDeleted()
+
+	// IncrReleased is called when a job is released.
+	IncrReleased()
+
+	// IncrBuried is called when a job is buried.
+	IncrBuried()
+
+	// ObserveDuration is called with how long each executed job took.
+	ObserveDuration(d time.Duration)
+}
+
+// SlowMetrics may be implemented by a Metrics to also count jobs exceeding
+// Broker.SlowJobThreshold.
+type SlowMetrics interface {
+
+	// IncrSlow is called when a job is slow.
+	IncrSlow()
+}
+
+// teeMetrics passes everything to both a and b.
+type teeMetrics struct {
+	a, b Metrics
+}
+
+func (t teeMetrics) IncrDeleted()  { t.a.IncrDeleted(); t.b.IncrDeleted() }
+func (t teeMetrics) IncrReleased() { t.a.IncrReleased(); t.b.IncrReleased() }
+func (t teeMetrics) IncrBuried()   { t.a.IncrBuried(); t.b.IncrBuried() }
+
+func (t teeMetrics) ObserveDuration(d time.Duration) {
+	t.a.ObserveDuration(d)
+	t.b.ObserveDuration(d)
+}
+
+func (t teeMetrics) IncrSlow() {
+	incrSlow(t.a)
+	incrSlow(t.b)
+}
+
+// incrSlow calls IncrSlow if m implements SlowMetrics.
+func incrSlow(m Metrics) {
+	if s, ok := m.(SlowMetrics); ok {
+		s.IncrSlow()
+	}
+}
+
+// Counters is an in-memory Metrics implementation.
+// The zero value is ready to use.
+type Counters struct {
+	deleted  atomic.Uint64
+	released atomic.Uint64
+	buried   atomic.Uint64
+	executed atomic.Uint64
+	duration atomic.Int64
+	slow     atomic.Uint64
+}
+
+func (c *Counters) IncrDeleted()  { c.deleted.Add(1) }
+func (c *Counters) IncrReleased() { c.released.Add(1) }
+func (c *Counters) IncrBuried()   { c.buried.Add(1) }
+func (c *Counters) IncrSlow()     { c.slow.Add(1) }
+
+func (c *Counters) ObserveDuration(d time.Duration) {
+	c.executed.Add(1)
+	c.duration.Add(int64(d))
+}
+
+// Deleted is the number of jobs deleted.
+func (c *Counters) Deleted() uint64 { return c.deleted.Load() }
+
+// Released is the number of jobs released.
+func (c *Counters) Released() uint64 { return c.released.Load() }
+
+// Buried is the number of jobs buried.
+func (c *Counters) Buried() uint64 { return c.buried.Load() }
+
+// Executed is the number of jobs executed.
+func (c *Counters) Executed() uint64 { return c.executed.Load() }
+
+// Slow is the number of jobs exceeding Broker.SlowJobThreshold.
+func (c *Counters) Slow() uint64 { return c.slow.Load() }
+
+// Duration is the total time spent executing jobs.
+func (c *Counters) Duration() time.Duration { return time.Duration(c.duration.Load()) }
@@ -0,0 +1,152 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Options configures a Broker created by NewWithOptions.
+// Fields correspond to the Broker fields of the same name; anything not
+// covered here can still be set on the returned Broker.
+type Options struct {
+
+	// Address of the beanstalkd server. May be left empty if Pool is set.
+	Address string
+
+	// Pool, if set, is shared with other brokers; see Broker.Pool.
+	Pool *Pool
+
+	// Tube or Tubes to service; Tubes replaces Tube if not empty.
+	Tube  string
+	Tubes []string
+
+	// Slot identifies the broker in log prefixes.
+	Slot uint64
+
+	// Cmd is the shell command to execute for each job, or Command the
+	// program and arguments to execute without a shell. Exactly one must
+	// be set.
+	Cmd     string
+	Command []string
+
+	Shell     []string
+	ShellPath string
+	ShellArgs []string
+
+	ReserveTimeout time.Duration
+	JobTimeout     time.Duration
+
+	// Concurrency is the number of jobs handled at once, at least 1.
+	Concurrency int
+
+	// Logger, if set, replaces the broker's default stdout logger. The
+	// broker logs through a copy with the same output, prefix and flags,
+	// so that setting its own prefix leaves Logger unchanged.
+	Logger *log.Logger
+
+	Metrics Metrics
+
+	// Results receives a JobResult for each job handled. May be nil.
+	Results chan<- *JobResult
+}
+
+// NewWithOptions creates a Broker from opts, returning an error describing
+// every problem found if the options can't work together.
+func NewWithOptions(opts Options) (*Broker, error) {
+	b, err := newWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// newWithOptions creates a Broker from opts, along with any error from
+// validating them.
+func newWithOptions(opts Options) (*Broker, error) {
+	if opts.Address == "" && opts.Pool != nil {
+		opts.Address = opts.Pool.Address()
+	}
+	b := &Broker{
+		Address: opts.Address,
+		Tube:    opts.Tube,
+		Cmd:     opts.Cmd,
+		results: opts.Results,
+		shared:  &shared{},
+		slot:    opts.Slot,
+	}
+	b.ShellPath, b.shellErr = lookupShell()
+	b.log = log.New(os.Stdout, fmt.Sprintf("[%s:%d] ", opts.Tube, opts.Slot), log.LstdFlags)
+	b.Tubes = opts.Tubes
+	b.Command = opts.Command
+	b.Shell = opts.Shell
+	if opts.ShellPath != "" {
+		b.ShellPath = opts.ShellPath
+	}
+	b.ShellArgs = opts.ShellArgs
+	b.ReserveTimeout = opts.ReserveTimeout
+	b.JobTimeout = opts.JobTimeout
+	b.Concurrency = opts.Concurrency
+	if opts.Logger != nil {
+		b.log = log.New(opts.Logger.Writer(), opts.Logger.Prefix(), opts.Logger.Flags())
+	}
+	b.Metrics = opts.Metrics
+	b.Pool = opts.Pool
+
+	return b, validateOptions(opts, b)
+}
+
+func validateOptions(opts Options, b *Broker) error {
+	msgs := make([]string, 0)
+
+	if opts.Address == "" {
+		msgs = append(msgs, "Address must not be empty.")
+	} else if opts.Pool != nil && opts.Pool.Address() != opts.Address {
+		msgs = append(msgs, "Address must match Pool's address.")
+	}
+
+	if opts.Tube == "" && len(opts.Tubes) == 0 {
+		msgs = append(msgs, "Tube or Tubes must be set.")
+	}
+
+	if opts.Cmd == "" && len(opts.Command) == 0 {
+		msgs = append(msgs, "Cmd or Command must be set.")
+	} else if opts.Cmd != "" && len(opts.Command) > 0 {
+		msgs = append(msgs, "Only one of Cmd and Command may be set.")
+	}
+
+	if b.usesDefaultShell() && b.ShellPath == "" && b.shellErr != nil {
+		msgs = append(msgs, "Cmd needs bash, but "+b.shellErr.Error()+".")
+	}
+
+	if len(opts.ShellArgs) > 0 && !hasCommandFlag(opts.ShellArgs) {
+		msgs = append(msgs, "ShellArgs must include -c.")
+	}
+
+	if opts.Concurrency < 1 {
+		msgs = append(msgs, "Concurrency must be at least 1.")
+	}
+
+	if opts.ReserveTimeout < 0 || opts.JobTimeout < 0 {
+		msgs = append(msgs, "Timeouts must not be negative.")
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// hasCommandFlag reports whether args include -c, alone or combined with
+// other single-letter options as in -lc.
+func hasCommandFlag(args []string) bool {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--") && strings.Contains(arg, "c") {
+			return true
+		}
+	}
+	return false
+}
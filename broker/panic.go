@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/99designs/cmdstalk/bs"
+)
+
+// hookPanic is a panic raised by a hook, such as Transform or OnEvent,
+// which Run recovers from. Panics elsewhere are bugs in the broker, and
+// propagate.
+type hookPanic struct {
+	hook  string
+	value interface{}
+	stack []byte
+}
+
+func (p *hookPanic) Error() string {
+	return fmt.Sprintf("panic in %s: %v", p.hook, p.value)
+}
+
+// inHook calls f, which calls the named hook, converting a panic into a
+// hookPanic.
+func inHook(hook string, f func()) {
+	defer func() {
+		if v := recover(); v != nil {
+			if _, ok := v.(*hookPanic); !ok {
+				v = &hookPanic{hook: hook, value: v, stack: debug.Stack()}
+			}
+			panic(v)
+		}
+	}()
+	f()
+}
+
+// recoverHook logs and counts v, the value recovered while handling the
+// job, if it is a hookPanic, and panics again with anything else.
+func (b *Broker) recoverHook(v interface{}, jobId uint64) *hookPanic {
+	if v == nil {
+		return nil
+	}
+	p, ok := v.(*hookPanic)
+	if !ok {
+		panic(v)
+	}
+	b.shared.recoveredPanics.Add(1)
+	b.setLastError(p)
+	b.logEvent(logFields{"event": "panic", "hook": p.hook, "job_id": jobId, "error": p.Error()},
+		"recovered from %s handling job %d\n%s", p, jobId, p.stack)
+	return p
+}
+
+// processJobRecovering is processJob, but if a hook panics the job is
+// released unchanged, if it is still reserved, and the panic returned as
+// the result's Error.
+func (b *Broker) processJobRecovering(ctx context.Context, job bs.Job) (result *JobResult, err error) {
+	defer func() {
+		if p := b.recoverHook(recover(), job.Id); p != nil {
+			pri, relErr := b.priority(job)
+			if relErr == nil {
+				relErr = job.ReleaseWithPriority(pri, 0)
+			}
+			if relErr != nil && !bs.NotFound(relErr) {
+				b.logf("releasing job %d after panic failed: %s", job.Id, relErr)
+			}
+			result, err = &JobResult{JobId: job.Id, Error: p}, nil
+		}
+	}()
+	return b.processJob(ctx, job)
+}
+
+// onResult calls OnResult, recovering from a panic in it; the job has
+// already been handled.
+func (b *Broker) onResult(result *JobResult) {
+	defer func() {
+		b.recoverHook(recover(), result.JobId)
+	}()
+	inHook("OnResult", func() { b.OnResult(result) })
+}
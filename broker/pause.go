@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/99designs/cmdstalk/bs"
+)
+
+// PauseCheckInterval is how often an idle broker checks whether its tubes
+// have been paused with pause-tube.
+const PauseCheckInterval = 30 * time.Second
+
+// checkPaused logs changes to which tubes are paused, at most once per
+// PauseCheckInterval, and with SleepWhilePaused sleeps until the first
+// resumes if they all are.
+func (b *Broker) checkPaused(ctx context.Context) {
+	if b.clock().Now().Sub(b.pauseChecked) < PauseCheckInterval {
+		return
+	}
+	b.pauseChecked = b.clock().Now()
+
+	var paused []string
+	var resume time.Duration
+	for _, name := range b.tubes() {
+		stats, err := b.conn.StatsTube(name)
+		if err != nil {
+			if !bs.NotFound(err) {
+				b.logf("checking whether %s is paused failed: %s", name, err)
+			}
+			return
+		}
+		left := time.Duration(parseCount(stats["pause-time-left"])) * time.Second
+		if left == 0 {
+			continue
+		}
+		paused = append(paused, name)
+		if resume == 0 || left < resume {
+			resume = left
+		}
+	}
+
+	if p := strings.Join(paused, ","); p != b.pausedTubes {
+		if p == "" {
+			b.logf("tubes resumed: %s", b.pausedTubes)
+		} else {
+			b.logf("tubes paused: %s (first resumes in %v)", p, resume)
+		}
+		b.pausedTubes = p
+	}
+
+	if b.SleepWhilePaused && len(paused) == len(b.tubes()) {
+		select {
+		case <-b.clock().After(resume):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Pause stops the broker reserving jobs until Resume is called. Jobs in
+// progress are finished, and a reserve already waiting may still return one
+// more, within ReserveTimeout. The connection to beanstalkd is kept. It is
+// safe to call concurrently with Run, and affects all Concurrency workers.
+func (b *Broker) Pause() {
+	b.shared.mu.Lock()
+	defer b.shared.mu.Unlock()
+	if b.shared.resume == nil {
+		b.shared.resume = make(chan struct{})
+		b.logf("pausing")
+	}
+}
+
+// Resume reserving jobs after Pause.
+func (b *Broker) Resume() {
+	b.shared.mu.Lock()
+	defer b.shared.mu.Unlock()
+	if b.shared.resume != nil {
+		close(b.shared.resume)
+		b.shared.resume = nil
+		b.logf("resuming")
+	}
+}
+
+// Paused reports whether Pause has been called without Resume.
+func (b *Broker) Paused() bool {
+	b.shared.mu.Lock()
+	defer b.shared.mu.Unlock()
+	return b.shared.resume != nil
+}
+
+// waitWhilePaused blocks while the broker is paused, returning ctx's error
+// if it is cancelled first.
+func (b *Broker) waitWhilePaused(ctx context.Context) error {
+	b.shared.mu.Lock()
+	resume := b.shared.resume
+	b.shared.mu.Unlock()
+
+	if resume != nil {
+		select {
+		case <-resume:
+		case <-ctx.Done():
+		}
+	}
+	return ctx.Err()
+}
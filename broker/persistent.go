@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/99designs/cmdstalk/bs"
+	"github.com/99designs/cmdstalk/cmd"
+)
+
+// executePersistent hands the job to the long-lived worker process, starting
+// it first if need be, and maps its response to a JobResult like that of an
+// exited command. If the process dies, breaks the framing or overruns a
+// timeout, it is killed, to be restarted for the next job, and the job is
+// released.
+func (b *Broker) executePersistent(job bs.Job, stdin []byte) (result *JobResult, err error) {
+	result = &JobResult{JobId: job.Id, Executed: true}
+
+	ttr, err := job.TimeLeft()
+	if err != nil {
+		return
+	}
+	ttrTimeout := b.clock().After(ttr + ttrMargin)
+
+	var jobTimeout <-chan time.Time
+	if b.JobTimeout > 0 {
+		jobTimeout = b.clock().After(b.JobTimeout)
+	}
+
+	cancelled := b.register(job.Id)
+	defer b.unregister(job.Id)
+
+	result.StartedAt = b.clock().Now()
+	defer func() {
+		result.Duration = b.clock().Now().Sub(result.StartedAt)
+	}()
+
+	if b.worker == nil {
+		b.logf("starting persistent worker: %q", b.argv(b.Cmd))
+		b.worker, err = cmd.StartProcess(b.argv(b.Cmd), b.Env, b.WorkDir, stderrLogger{b})
+		if err != nil {
+			result.ExitStatus = -1
+			if notFound(err) {
+				result.CommandNotFound = true
+				result.ExitStatus = ExitCommandNotFound
+				result.Error = err
+			} else {
+				result.Err = fmt.Errorf("%w: persistent worker: %w", ErrCommandStart, err)
+			}
+			return result, nil
+		}
+	}
+
+	type response struct {
+		status int
+		output []byte
+		err    error
+	}
+	done := make(chan response, 1)
+	go func() {
+		status, output, err := b.worker.Exchange(job.Id, stdin)
+		done <- response{status, output, err}
+	}()
+
+	var r response
+	select {
+	case r = <-done:
+	case <-ttrTimeout:
+		result.TimedOut = true
+	case <-jobTimeout:
+		result.JobTimedOut = true
+	case <-cancelled:
+		b.logf("job %d cancelled, killing persistent worker", job.Id)
+		result.Cancelled = true
+	}
+	if result.TimedOut || result.JobTimedOut || result.Cancelled {
+		b.stopWorker(true)
+		<-done
+		result.ExitStatus = -1
+		return
+	}
+
+	if r.err != nil {
+		b.stopWorker(true)
+		result.ExitStatus = -1
+		result.Err = fmt.Errorf("persistent worker: %w", r.err)
+		return
+	}
+	result.ExitStatus = r.status
+	result.Stdout = b.appendStdout(nil, r.output)
+	return
+}
+
+// stopWorker stops the persistent worker process, if it is running, by
+// killing it or by closing its stdin and waiting for it to exit. It waits at
+// most KillGrace, or workerCloseTimeout if that isn't set, before killing it.
+func (b *Broker) stopWorker(kill bool) {
+	if b.worker == nil {
+		return
+	}
+	timeout := b.KillGrace
+	if timeout <= 0 {
+		timeout = workerCloseTimeout
+	}
+	if kill {
+		b.worker.Kill()
+	} else if wr := b.worker.Close(timeout); wr.Err != nil || wr.Status != 0 {
+		b.logf("persistent worker exited with exit(%d): %v", wr.Status, wr.Err)
+	}
+	b.worker = nil
+}
+
+// stderrLogger logs what is written to it as worker stderr.
+type stderrLogger struct {
+	b *Broker
+}
+
+func (l stderrLogger) Write(p []byte) (int, error) {
+	l.b.logf("stderr: %s", p)
+	return len(p), nil
+}
@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"github.com/99designs/cmdstalk/bs"
+	"github.com/kr/beanstalk"
+)
+
+// Pool is a set of connections to beanstalkd shared by Brokers for requests
+// made outside their run loops, such as Put, Stats and Kick, in place of a
+// control connection each.
+//
+// Reserves, and the delete, release, bury and touch of a reserved job, stay
+// on each broker's own connections: beanstalkd only accepts those from the
+// connection which reserved the job.
+//
+// Connections are dialed as the broker needing one would dial its own, with
+// its TLSConfig and ConnectHook, so brokers sharing a pool should agree on
+// those.
+type Pool struct {
+	address string
+
+	// idle connections, ready for use.
+	idle chan *beanstalk.Conn
+
+	// open holds a token for each connection dialed, limiting them to the
+	// pool's size.
+	open chan struct{}
+}
+
+// NewPool creates a pool of at most size connections to address, dialed as
+// needed. A size below 1 means 1.
+func NewPool(address string, size int) *Pool {
+	size = max(size, 1)
+	return &Pool{
+		address: address,
+		idle:    make(chan *beanstalk.Conn, size),
+		open:    make(chan struct{}, size),
+	}
+}
+
+// Address the pool connects to.
+func (p *Pool) Address() string {
+	return p.address
+}
+
+// get an idle connection, dialing a new one with dial if there are none and
+// the pool isn't full, otherwise waiting for one to be returned.
+func (p *Pool) get(dial func() (*beanstalk.Conn, error)) (*beanstalk.Conn, error) {
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	default:
+	}
+
+	select {
+	case conn := <-p.idle:
+		return conn, nil
+	case p.open <- struct{}{}:
+		conn, err := dial()
+		if err != nil {
+			<-p.open
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// put returns conn to the pool, or closes it if err shows it was lost.
+func (p *Pool) put(conn *beanstalk.Conn, err error) {
+	if bs.ConnectionLost(err) {
+		conn.Close()
+		<-p.open
+		return
+	}
+	p.idle <- conn
+}
+
+// with calls f with a connection from the pool, dialed by dial if needed.
+func (p *Pool) with(dial func() (*beanstalk.Conn, error), f func(conn *beanstalk.Conn) error) error {
+	conn, err := p.get(dial)
+	if err != nil {
+		return err
+	}
+	err = f(conn)
+	p.put(conn, err)
+	return err
+}
+
+// Close the pool's idle connections, once the brokers using it have
+// stopped.
+func (p *Pool) Close() error {
+	var err error
+	for {
+		select {
+		case conn := <-p.idle:
+			if e := conn.Close(); e != nil && err == nil {
+				err = e
+			}
+			<-p.open
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"context"
+	"time"
+
+	"github.com/99designs/cmdstalk/bs"
+)
+
+// prefetched is a job reserved ahead for Prefetch.
+type prefetched struct {
+	job bs.Job
+	ttr time.Duration
+}
+
+// nextJob returns the oldest prefetched job, touched to renew its TTR, or
+// else reserves one.
+func (b *Broker) nextJob(ctx context.Context) (bs.Job, error) {
+	for len(b.prefetched) > 0 {
+		p := b.prefetched[0]
+		b.prefetched = b.prefetched[1:]
+		err := p.job.Touch()
+		if err == nil {
+			return p.job, nil
+		}
+		if !b.prefetchLost(p.job, err) {
+			// The connection is lost, and the remaining jobs with it;
+			// reserve reconnects.
+			b.logf("touching prefetched job %d failed: %s", p.job.Id, err)
+			b.prefetched = nil
+		}
+	}
+
+	id, body, err := b.reserve(ctx)
+	if err != nil {
+		return bs.Job{}, err
+	}
+	return bs.NewJob(id, body, b.conn), nil
+}
+
+// startPrefetch hands the prefetched jobs to a goroutine which, while the
+// current job is handled, reserves more without waiting, up to Prefetch,
+// and touches them before they reach their TTR. The returned func stops it
+// and takes the jobs back.
+func (b *Broker) startPrefetch() (stop func()) {
+	if b.Prefetch <= 0 {
+		return func() {}
+	}
+	queue := b.prefetched
+	b.prefetched = nil
+	conn, ts := b.conn, b.ts
+	quit := make(chan struct{})
+	done := make(chan []prefetched, 1)
+	go func() {
+		done <- b.prefetch(conn, ts, queue, quit)
+	}()
+	return func() {
+		close(quit)
+		queue := <-done
+		if b.conn == conn {
+			b.prefetched = queue
+		}
+		// Otherwise the connection was replaced while handling the job, and
+		// closing it returned the jobs to ready.
+	}
+}
+
+// prefetch tops up queue, then keeps it touched, until quit is closed.
+func (b *Broker) prefetch(conn bs.Conn, ts bs.Reserver, queue []prefetched, quit <-chan struct{}) []prefetched {
+	for len(queue) < b.Prefetch {
+		select {
+		case <-quit:
+			return queue
+		default:
+		}
+		id, body, ok, err := bs.ReserveWithTimeoutSleep(ts, 0, b.clock().Sleep)
+		if err != nil {
+			b.logf("prefetching failed: %s", err)
+			break
+		}
+		if !ok {
+			break
+		}
+		job := bs.NewJob(id, body, conn)
+		ttr, err := job.TTR()
+		if err != nil {
+			b.logf("reading TTR of prefetched job %d failed: %s", id, err)
+			ttr = time.Second // touched as often as is useful
+		}
+		b.logEvent(logFields{"event": "prefetch", "job_id": id}, "prefetched job %d", id)
+		queue = append(queue, prefetched{job, ttr})
+	}
+
+	for {
+		var touch <-chan time.Time
+		if len(queue) > 0 {
+			interval := queue[0].ttr
+			for _, p := range queue {
+				interval = min(interval, p.ttr)
+			}
+			touch = b.clock().After(interval / 2)
+		}
+		select {
+		case <-quit:
+			return queue
+		case <-touch:
+		}
+
+		kept := queue[:0]
+		for _, p := range queue {
+			err := p.job.Touch()
+			if err == nil {
+				kept = append(kept, p)
+			} else if !b.prefetchLost(p.job, err) {
+				b.logf("touching prefetched job %d failed: %s", p.job.Id, err)
+				kept = append(kept, p) // nextJob finds out for sure
+			}
+		}
+		queue = kept
+	}
+}
+
+// prefetchLost reports whether err is NOT_FOUND from touching a prefetched
+// job, meaning it reached its TTR, and counts it as lost.
+func (b *Broker) prefetchLost(job bs.Job, err error) bool {
+	if !bs.NotFound(err) {
+		return false
+	}
+	b.shared.lostJobs.Add(1)
+	b.logEvent(logFields{"event": "lost", "action": "touch", "job_id": job.Id},
+		"warning: prefetched job %d not found to touch, its reservation was probably lost to TTR", job.Id)
+	return true
+}
@@ -0,0 +1,93 @@
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultRateWindow is the window Rate is computed over if RateWindow is
+// zero.
+const DefaultRateWindow = time.Minute
+
+// rateWindow counts executed jobs, and those which succeeded, in one second
+// buckets.
+type rateWindow struct {
+	mu      sync.Mutex
+	buckets []rateBucket // oldest first
+}
+
+type rateBucket struct {
+	sec       int64
+	total, ok uint64
+}
+
+// add counts a job executed at now, discarding buckets older than window
+// so that they don't accumulate if Rate is never called.
+func (r *rateWindow) add(now time.Time, window time.Duration, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.trim(now, window)
+	sec := now.Unix()
+	if n := len(r.buckets); n == 0 || r.buckets[n-1].sec != sec {
+		r.buckets = append(r.buckets, rateBucket{sec: sec})
+	}
+	last := &r.buckets[len(r.buckets)-1]
+	last.total++
+	if ok {
+		last.ok++
+	}
+}
+
+// sum counts the jobs executed within window of now, discarding older
+// buckets.
+func (r *rateWindow) sum(now time.Time, window time.Duration) (total, ok uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.trim(now, window)
+	for _, bucket := range r.buckets {
+		total += bucket.total
+		ok += bucket.ok
+	}
+	return
+}
+
+// trim discards the buckets older than window. Guarded by mu.
+func (r *rateWindow) trim(now time.Time, window time.Duration) {
+	since := now.Add(-window).Unix()
+	i := 0
+	for i < len(r.buckets) && r.buckets[i].sec <= since {
+		i++
+	}
+	r.buckets = r.buckets[i:]
+}
+
+// rateWindow is RateWindow, or DefaultRateWindow if it is zero.
+func (b *Broker) rateWindow() time.Duration {
+	if b.RateWindow <= 0 {
+		return DefaultRateWindow
+	}
+	return b.RateWindow
+}
+
+// Rate reports the jobs executed per second over the last RateWindow, and
+// the fraction of them which exited 0. The ratio is 0 if no jobs were
+// executed. It is safe to call concurrently with Run.
+func (b *Broker) Rate() (jobsPerSec float64, successRatio float64) {
+	window := b.rateWindow()
+	total, ok := b.shared.rate.sum(b.clock().Now(), window)
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(total) / window.Seconds(), float64(ok) / float64(total)
+}
+
+// recordRate counts an executed job towards Rate.
+func (b *Broker) recordRate(result *JobResult) {
+	if result == nil || !result.Executed {
+		return
+	}
+	ok := result.ExitStatus == 0 && result.Err == nil
+	b.shared.rate.add(b.clock().Now(), b.rateWindow(), ok)
+}
@@ -0,0 +1,55 @@
+package broker
+
+import "sync"
+
+// recentResults is a ring buffer of the last results, for RecentResults.
+type recentResults struct {
+	mu   sync.Mutex
+	buf  []JobResult // allocated by the first add
+	next int         // index the next result is stored at
+	full bool        // whether buf has wrapped
+}
+
+// add stores a copy of result, overwriting the oldest once size are held.
+func (r *recentResults) add(result *JobResult, size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.buf == nil {
+		r.buf = make([]JobResult, size)
+	}
+	r.buf[r.next] = *result
+	r.next++
+	if r.next == len(r.buf) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// list copies the held results, oldest first.
+func (r *recentResults) list() []JobResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]JobResult(nil), r.buf[:r.next]...)
+	}
+	return append(append([]JobResult(nil), r.buf[r.next:]...), r.buf[:r.next]...)
+}
+
+// RecentResults returns copies of the last RecentResults results, oldest
+// first, from all workers. It is nil if RecentResults is zero, and is safe
+// to call concurrently with Run.
+func (b *Broker) RecentResults() []JobResult {
+	if b.RecentResultsSize <= 0 {
+		return nil
+	}
+	return b.shared.recent.list()
+}
+
+// recordRecent keeps a copy of result for RecentResults.
+func (b *Broker) recordRecent(result *JobResult) {
+	if b.RecentResultsSize > 0 {
+		b.shared.recent.add(result, b.RecentResultsSize)
+	}
+}
@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// DialErrorClass is a kind of failure to connect to beanstalkd, which may
+// warrant its own reconnect backoff.
+type DialErrorClass int
+
+const (
+	// DialOther is any failure not classified below, e.g. a TLS handshake
+	// or ConnectHook failure.
+	DialOther DialErrorClass = iota
+
+	// DialRefused is the connection being refused or the host unreachable,
+	// suggesting beanstalkd is down.
+	DialRefused
+
+	// DialTransient is the connection being reset, closed or timing out,
+	// suggesting a blip which may clear quickly.
+	DialTransient
+)
+
+var dialErrorClassNames = map[DialErrorClass]string{
+	DialOther:     "other",
+	DialRefused:   "refused",
+	DialTransient: "transient",
+}
+
+func (c DialErrorClass) String() string {
+	if name, ok := dialErrorClassNames[c]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ReconnectPolicy sets the initial delay before redialling beanstalkd by
+// the class of the failure, in place of ReconnectDelay. Each doubles after
+// further failures of the same class, up to ReconnectMaxDelay, and Jitter
+// applies as usual. A failure of a different class starts again from that
+// class's delay. Zero means ReconnectDelay for that class.
+type ReconnectPolicy struct {
+	Refused   time.Duration
+	Transient time.Duration
+	Other     time.Duration
+}
+
+// classifyDialError returns the class of a failure to connect.
+func classifyDialError(err error) DialErrorClass {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH):
+		return DialRefused
+	case errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return DialTransient
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return DialTransient
+	}
+	return DialOther
+}
+
+// reconnectDelay is the initial delay after a failure of the class.
+func (b *Broker) reconnectDelay(class DialErrorClass) time.Duration {
+	var delay time.Duration
+	if p := b.ReconnectPolicy; p != nil {
+		switch class {
+		case DialRefused:
+			delay = p.Refused
+		case DialTransient:
+			delay = p.Transient
+		default:
+			delay = p.Other
+		}
+	}
+	if delay == 0 {
+		delay = b.ReconnectDelay
+	}
+	if delay == 0 {
+		delay = DefaultReconnectDelay
+	}
+	return delay
+}
@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// resultWriterBacklog is how many encoded results may await writing to
+// Broker.ResultWriter before further results are dropped.
+const resultWriterBacklog = 1024
+
+// resultWriter writes JSON lines to an io.Writer from its own goroutine, so
+// that a slow file or socket doesn't hold up the broker loop.
+type resultWriter struct {
+	lines chan []byte
+	done  chan struct{}
+}
+
+func newResultWriter(w io.Writer, logf func(format string, args ...interface{})) *resultWriter {
+	rw := &resultWriter{
+		lines: make(chan []byte, resultWriterBacklog),
+		done:  make(chan struct{}),
+	}
+	go func() {
+		defer close(rw.done)
+		for line := range rw.lines {
+			if _, err := w.Write(line); err != nil {
+				logf("writing result failed: %s", err)
+			}
+		}
+	}()
+	return rw
+}
+
+// write queues result, returning false if the backlog is full.
+func (rw *resultWriter) write(result *JobResult) (bool, error) {
+	line, err := json.Marshal(result)
+	if err != nil {
+		return false, err
+	}
+	select {
+	case rw.lines <- append(line, '\n'):
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// close waits for queued results to be written.
+func (rw *resultWriter) close() {
+	close(rw.lines)
+	<-rw.done
+}
+
+// MarshalJSON encodes Stdout as a string, and Err and Error as their
+// messages.
+func (r JobResult) MarshalJSON() ([]byte, error) {
+	type plain JobResult
+	var errMsg, execErrMsg string
+	if r.Error != nil {
+		errMsg = r.Error.Error()
+	}
+	if r.Err != nil {
+		execErrMsg = r.Err.Error()
+	}
+	return json.Marshal(struct {
+		plain
+		Stdout string
+		Err    string `json:",omitempty"`
+		Error  string `json:",omitempty"`
+	}{plain(r), string(r.Stdout), execErrMsg, errMsg})
+}
+
+// MarshalText encodes the action as its String.
+func (a Action) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
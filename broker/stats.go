@@ -0,0 +1,123 @@
+package broker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// BrokerStats describes the state of a Broker and the tubes it services.
+type BrokerStats struct {
+
+	// Tubes holds stats-tube counts for each serviced tube, by name.
+	Tubes map[string]TubeStats
+
+	// Executed is the number of jobs executed.
+	Executed uint64
+
+	// Deleted is the number of jobs deleted.
+	Deleted uint64
+
+	// Released is the number of jobs released.
+	Released uint64
+
+	// Buried is the number of jobs buried.
+	Buried uint64
+
+	// DroppedResults is the number of results discarded according to
+	// Broker.ResultsPolicy.
+	DroppedResults uint64
+
+	// DiscardedStdoutBytes is the number of bytes of worker stdout dropped
+	// because Broker.MaxTotalStdoutBytes was reached.
+	DiscardedStdoutBytes uint64
+
+	// RejectedJobs is the number of jobs rejected by Broker.MaxBodyBytes.
+	RejectedJobs uint64
+
+	// LostJobs is the number of jobs which beanstalkd no longer had
+	// reserved when the broker went to delete, release or bury them,
+	// usually because their TTR expired.
+	LostJobs uint64
+
+	// RecoveredPanics is the number of panics in hooks, such as Transform
+	// or OnEvent, which the broker recovered from, releasing the job.
+	RecoveredPanics uint64
+
+	// SlowJobs is the number of jobs whose command ran longer than
+	// Broker.SlowJobThreshold.
+	SlowJobs uint64
+
+	// Paused is true if Broker.Pause has stopped it reserving jobs.
+	Paused bool
+
+	// LastError is the most recent error encountered, if any.
+	LastError error
+}
+
+// TubeStats holds job counts and pause state reported by stats-tube.
+type TubeStats struct {
+	Ready    uint64
+	Reserved uint64
+	Delayed  uint64
+	Buried   uint64
+
+	// Paused is true if the tube has been paused with pause-tube, for
+	// PauseTimeLeft more.
+	Paused        bool
+	PauseTimeLeft time.Duration
+}
+
+// Stats reports the broker's counters along with stats-tube for each
+// serviced tube. It is safe to call concurrently with Run.
+func (b *Broker) Stats() (BrokerStats, error) {
+	c := &b.shared.counters
+	stats := BrokerStats{
+		Tubes:    make(map[string]TubeStats),
+		Executed: c.Executed(),
+		Deleted:  c.Deleted(),
+		Released: c.Released(),
+		Buried:   c.Buried(),
+		SlowJobs: c.Slow(),
+
+		DroppedResults:       b.shared.droppedResults.Load(),
+		DiscardedStdoutBytes: b.shared.discardedStdout.Load(),
+		RejectedJobs:         b.shared.rejected.Load(),
+		LostJobs:             b.shared.lostJobs.Load(),
+		RecoveredPanics:      b.shared.recoveredPanics.Load(),
+	}
+
+	b.shared.mu.Lock()
+	stats.LastError = b.shared.lastErr
+	stats.Paused = b.shared.resume != nil
+	b.shared.mu.Unlock()
+
+	err := b.withControlConn(func(conn *beanstalk.Conn) error {
+		for _, name := range b.tubes() {
+			tube := beanstalk.Tube{Conn: conn, Name: name}
+			ts, err := tube.Stats()
+			if err != nil {
+				return err
+			}
+			left := time.Duration(parseCount(ts["pause-time-left"])) * time.Second
+			stats.Tubes[name] = TubeStats{
+				Ready:    parseCount(ts["current-jobs-ready"]),
+				Reserved: parseCount(ts["current-jobs-reserved"]),
+				Delayed:  parseCount(ts["current-jobs-delayed"]),
+				Buried:   parseCount(ts["current-jobs-buried"]),
+
+				Paused:        left > 0,
+				PauseTimeLeft: left,
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// parseCount parses a stats value, treating malformed values as zero.
+func parseCount(s string) uint64 {
+	n, _ := strconv.ParseUint(s, 10, 64)
+	return n
+}
@@ -5,6 +5,7 @@
 package bs
 
 import (
+	"errors"
 	"time"
 
 	"github.com/kr/beanstalk"
@@ -16,23 +17,126 @@ const (
 	DeadlineSoonDelay = 1 * time.Second
 )
 
+// Reserver reserves jobs, as beanstalk.TubeSet does, allowing it to be
+// replaced in tests.
+type Reserver interface {
+	Reserve(timeout time.Duration) (id uint64, body []byte, err error)
+}
+
 // reserve-with-timeout until there's a job or something panic-worthy.
 // Handles beanstalk.ErrTimeout by retrying immediately.
 // Handles beanstalk.ErrDeadline by sleeping DeadlineSoonDelay before retry.
 // panics for other errors.
-func MustReserveWithoutTimeout(ts *beanstalk.TubeSet) (id uint64, body []byte) {
-	var err error
+func MustReserveWithoutTimeout(ts Reserver) (id uint64, body []byte) {
+	var ok bool
 	for {
-		id, body, err = ts.Reserve(1 * time.Hour)
-		if err == nil {
+		id, body, ok = MustReserveWithTimeout(ts, 1*time.Hour)
+		if ok {
 			return
-		} else if err.(beanstalk.ConnError).Err == beanstalk.ErrTimeout {
-			continue
-		} else if err.(beanstalk.ConnError).Err == beanstalk.ErrDeadline {
-			time.Sleep(DeadlineSoonDelay)
-			continue
-		} else {
-			panic(err)
 		}
 	}
 }
+
+// reserve-with-timeout once, returning ok == false if no job was reserved.
+// Handles beanstalk.ErrTimeout by returning immediately.
+// Handles beanstalk.ErrDeadline by sleeping DeadlineSoonDelay before returning.
+// panics for other errors.
+func MustReserveWithTimeout(ts Reserver, timeout time.Duration) (id uint64, body []byte, ok bool) {
+	id, body, ok, err := ReserveWithTimeout(ts, timeout)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+// reserve-with-timeout once, returning ok == false if no job was reserved.
+// Handles beanstalk.ErrTimeout by returning immediately.
+// Handles beanstalk.ErrDeadline by sleeping DeadlineSoonDelay before returning.
+// Other errors are returned.
+func ReserveWithTimeout(ts Reserver, timeout time.Duration) (id uint64, body []byte, ok bool, err error) {
+	return ReserveWithTimeoutSleep(ts, timeout, time.Sleep)
+}
+
+// ReserveWithTimeoutSleep is like ReserveWithTimeout, but sleeps with sleep,
+// e.g. a replaceable clock's.
+func ReserveWithTimeoutSleep(ts Reserver, timeout time.Duration, sleep func(time.Duration)) (id uint64, body []byte, ok bool, err error) {
+	id, body, err = ts.Reserve(timeout)
+	if err == nil {
+		return id, body, true, nil
+	}
+	switch connErr(err) {
+	case beanstalk.ErrTimeout:
+		return 0, nil, false, nil
+	case beanstalk.ErrDeadline:
+		sleep(DeadlineSoonDelay)
+		return 0, nil, false, nil
+	default:
+		return 0, nil, false, err
+	}
+}
+
+// ConnectionLost reports whether err means the connection to beanstalkd can
+// no longer be used, e.g. a network error, as opposed to a beanstalkd
+// response such as NOT_FOUND.
+func ConnectionLost(err error) bool {
+	var e beanstalk.ConnError
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch connErr(err) {
+	case beanstalk.ErrBadFormat,
+		beanstalk.ErrBuried,
+		beanstalk.ErrDeadline,
+		beanstalk.ErrDraining,
+		beanstalk.ErrInternal,
+		beanstalk.ErrJobTooBig,
+		beanstalk.ErrNoCRLF,
+		beanstalk.ErrNotFound,
+		beanstalk.ErrNotIgnored,
+		beanstalk.ErrOOM,
+		beanstalk.ErrTimeout,
+		beanstalk.ErrUnknown:
+		return false
+	}
+	return true
+}
+
+// Transient reports whether err is a beanstalkd response which may not
+// recur if the request is repeated on the same connection, e.g. OUT_OF_MEMORY.
+func Transient(err error) bool {
+	switch connErr(err) {
+	case beanstalk.ErrDeadline,
+		beanstalk.ErrInternal,
+		beanstalk.ErrOOM:
+		return true
+	}
+	return false
+}
+
+// NotFound reports whether err is beanstalkd's NOT_FOUND response, e.g. for
+// a job which has been deleted or a tube which doesn't exist.
+func NotFound(err error) bool {
+	return connErr(err) == beanstalk.ErrNotFound
+}
+
+// DeadlineSoon reports whether err is beanstalkd's DEADLINE_SOON response
+// to a reserve, meaning a job reserved on the connection is about to time
+// out.
+func DeadlineSoon(err error) bool {
+	return connErr(err) == beanstalk.ErrDeadline
+}
+
+// TimedOut reports whether err is beanstalkd's TIMED_OUT response to a
+// reserve with timeout.
+func TimedOut(err error) bool {
+	return connErr(err) == beanstalk.ErrTimeout
+}
+
+// connErr unwraps the error from a beanstalk.ConnError.
+func connErr(err error) error {
+	var e beanstalk.ConnError
+	if errors.As(err, &e) {
+		return e.Err
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package bs
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// TestReserveWithTimeoutDeadlineSoon simulates beanstalkd answering a reserve
+// with DEADLINE_SOON, which should be reported as no job rather than an error.
+func TestReserveWithTimeoutDeadlineSoon(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go fakeServer(l, "DEADLINE_SOON")
+
+	c, err := beanstalk.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	_, _, ok, err := ReserveWithTimeout(beanstalk.NewTubeSet(c, "default"), time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if ok {
+		t.Fatal("expected no job to be reserved")
+	}
+	if d := time.Since(start); d < DeadlineSoonDelay {
+		t.Fatalf("returned after %v, expected to sleep %v", d, DeadlineSoonDelay)
+	}
+}
+
+// timeoutReserver always times out.
+type timeoutReserver struct{}
+
+func (timeoutReserver) Reserve(timeout time.Duration) (uint64, []byte, error) {
+	return 0, nil, beanstalk.ConnError{Op: "reserve-with-timeout", Err: beanstalk.ErrTimeout}
+}
+
+func TestReserveWithTimeoutTimedOut(t *testing.T) {
+	_, _, ok, err := ReserveWithTimeout(timeoutReserver{}, time.Second)
+	if err != nil || ok {
+		t.Fatalf("ReserveWithTimeout returned ok %v, err %v; expected no job and no error", ok, err)
+	}
+}
+
+// fakeServer accepts one connection on l, answering watch and ignore
+// commands as beanstalkd would and reserves with reserveReply.
+func fakeServer(l net.Listener, reserveReply string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		reply := "UNKNOWN_COMMAND"
+		switch {
+		case strings.HasPrefix(line, "watch "), strings.HasPrefix(line, "ignore "):
+			reply = "WATCHING 1"
+		case strings.HasPrefix(line, "reserve"):
+			reply = reserveReply
+		}
+		if _, err := conn.Write([]byte(reply + "\r\n")); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package bs
+
+import (
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// Conn is the subset of a beanstalkd connection used to reserve and handle
+// jobs, allowing it to be replaced, e.g. by a Fake in tests.
+type Conn interface {
+	// Put a job into the named tube.
+	Put(tube string, body []byte, pri uint32, delay, ttr time.Duration) (id uint64, err error)
+
+	Delete(id uint64) error
+	Release(id uint64, pri uint32, delay time.Duration) error
+	Bury(id uint64, pri uint32) error
+	Touch(id uint64) error
+	StatsJob(id uint64) (map[string]string, error)
+
+	// StatsTube reports stats-tube for the named tube.
+	StatsTube(tube string) (map[string]string, error)
+
+	// PeekReady and PeekDelayed peek at the next job in the named tube.
+	PeekReady(tube string) (id uint64, body []byte, err error)
+	PeekDelayed(tube string) (id uint64, body []byte, err error)
+
+	// NewReserver returns a Reserver watching exactly the named tubes.
+	NewReserver(tubes ...string) Reserver
+
+	Close() error
+}
+
+// beanstalkConn adapts a beanstalk.Conn to Conn.
+type beanstalkConn struct {
+	c *beanstalk.Conn
+}
+
+// NewConn returns c as a Conn.
+func NewConn(c *beanstalk.Conn) Conn {
+	return beanstalkConn{c}
+}
+
+// BeanstalkConn returns the beanstalk.Conn underlying conn, if it was made
+// by NewConn.
+func BeanstalkConn(conn Conn) (*beanstalk.Conn, bool) {
+	c, ok := conn.(beanstalkConn)
+	return c.c, ok
+}
+
+func (c beanstalkConn) Put(tube string, body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	t := beanstalk.Tube{Conn: c.c, Name: tube}
+	return t.Put(body, pri, delay, ttr)
+}
+
+func (c beanstalkConn) Delete(id uint64) error { return c.c.Delete(id) }
+
+func (c beanstalkConn) Release(id uint64, pri uint32, delay time.Duration) error {
+	return c.c.Release(id, pri, delay)
+}
+
+func (c beanstalkConn) Bury(id uint64, pri uint32) error { return c.c.Bury(id, pri) }
+
+func (c beanstalkConn) Touch(id uint64) error { return c.c.Touch(id) }
+
+func (c beanstalkConn) StatsJob(id uint64) (map[string]string, error) { return c.c.StatsJob(id) }
+
+func (c beanstalkConn) StatsTube(tube string) (map[string]string, error) {
+	t := beanstalk.Tube{Conn: c.c, Name: tube}
+	return t.Stats()
+}
+
+func (c beanstalkConn) PeekReady(tube string) (uint64, []byte, error) {
+	t := beanstalk.Tube{Conn: c.c, Name: tube}
+	return t.PeekReady()
+}
+
+func (c beanstalkConn) PeekDelayed(tube string) (uint64, []byte, error) {
+	t := beanstalk.Tube{Conn: c.c, Name: tube}
+	return t.PeekDelayed()
+}
+
+func (c beanstalkConn) NewReserver(tubes ...string) Reserver {
+	return beanstalk.NewTubeSet(c.c, tubes...)
+}
+
+func (c beanstalkConn) Close() error { return c.c.Close() }
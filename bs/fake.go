@@ -0,0 +1,440 @@
+package bs
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+// errFakeClosed is returned by a closed Fake connection, which
+// ConnectionLost reports as lost.
+var errFakeClosed = errors.New("use of closed connection")
+
+// Fake is an in-memory beanstalkd, for testing code which reserves and
+// handles jobs without a server. Jobs move between ready, delayed, reserved
+// and buried as with beanstalkd: a reservation belongs to the connection
+// which made it, and returns the job to ready when its TTR runs out or the
+// connection is closed. Delays and TTRs run in real time.
+//
+// It is safe for concurrent use.
+type Fake struct {
+	mu       sync.Mutex
+	changed  chan struct{} // closed and replaced when a job may have become ready
+	lastId   uint64
+	jobs     map[uint64]*fakeJob
+	failures map[string][]error
+}
+
+type fakeJob struct {
+	id       uint64
+	tube     string
+	body     []byte
+	pri      uint32
+	state    string
+	delay    time.Duration
+	ttr      time.Duration
+	created  time.Time
+	until    time.Time // delayed until, or reserved until
+	owner    *fakeConn
+	reserves uint64
+	timeouts uint64
+	releases uint64
+	buries   uint64
+}
+
+// NewFake returns an empty Fake.
+func NewFake() *Fake {
+	return &Fake{
+		changed:  make(chan struct{}),
+		jobs:     make(map[uint64]*fakeJob),
+		failures: make(map[string][]error),
+	}
+}
+
+// Conn returns a new connection to f.
+func (f *Fake) Conn() Conn {
+	return &fakeConn{f: f}
+}
+
+// Fail makes the next call of the named operation, e.g. "delete" or
+// "reserve-with-timeout", fail with err, wrapped in a beanstalk.ConnError
+// as a real connection's are. Calling it repeatedly queues further
+// failures.
+func (f *Fake) Fail(op string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = append(f.failures[op], err)
+}
+
+// Len is the number of jobs in f, in any state.
+func (f *Fake) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.jobs)
+}
+
+// begin locks f, brings job states up to date, and returns any failure
+// queued for op.
+func (f *Fake) begin(c *fakeConn, op string) error {
+	f.mu.Lock()
+	if c.closed {
+		return beanstalk.ConnError{Op: op, Err: errFakeClosed}
+	}
+	f.update(time.Now())
+	if errs := f.failures[op]; len(errs) > 0 {
+		f.failures[op] = errs[1:]
+		return beanstalk.ConnError{Op: op, Err: errs[0]}
+	}
+	return nil
+}
+
+// update moves jobs whose delay or reservation has run out to ready.
+func (f *Fake) update(now time.Time) {
+	for _, j := range f.jobs {
+		if j.state == "reserved" && !now.Before(j.until) {
+			j.timeouts++
+			f.ready(j)
+		} else if j.state == "delayed" && !now.Before(j.until) {
+			f.ready(j)
+		}
+	}
+}
+
+func (f *Fake) ready(j *fakeJob) {
+	j.state, j.owner, j.until = "ready", nil, time.Time{}
+	f.notify()
+}
+
+// notify wakes reserves waiting on f.changed.
+func (f *Fake) notify() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// next returns the most urgent job in the state in any of the tubes, or
+// nil. Delayed jobs are ordered by when they become ready.
+func (f *Fake) next(state string, tubes ...string) *fakeJob {
+	var best *fakeJob
+	for _, j := range f.jobs {
+		if j.state != state || !contains(tubes, j.tube) {
+			continue
+		}
+		if best == nil || f.before(j, best) {
+			best = j
+		}
+	}
+	return best
+}
+
+func (f *Fake) before(a, b *fakeJob) bool {
+	if a.state == "delayed" && !a.until.Equal(b.until) {
+		return a.until.Before(b.until)
+	}
+	if a.pri != b.pri {
+		return a.pri < b.pri
+	}
+	return a.id < b.id
+}
+
+// wake is when the next delayed job becomes ready or reservation runs out.
+func (f *Fake) wake() (t time.Time) {
+	for _, j := range f.jobs {
+		if (j.state == "delayed" || j.state == "reserved") && (t.IsZero() || j.until.Before(t)) {
+			t = j.until
+		}
+	}
+	return
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeConn is a connection to a Fake.
+type fakeConn struct {
+	f      *Fake
+	closed bool
+}
+
+func notFound(op string) error {
+	return beanstalk.ConnError{Op: op, Err: beanstalk.ErrNotFound}
+}
+
+func (c *fakeConn) Put(tube string, body []byte, pri uint32, delay, ttr time.Duration) (uint64, error) {
+	f := c.f
+	err := f.begin(c, "put")
+	defer f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	f.lastId++
+	now := time.Now()
+	j := &fakeJob{
+		id:      f.lastId,
+		tube:    tube,
+		body:    append([]byte(nil), body...),
+		pri:     pri,
+		delay:   delay,
+		ttr:     max(ttr, time.Second),
+		created: now,
+	}
+	f.jobs[j.id] = j
+	if delay > 0 {
+		j.state, j.until = "delayed", now.Add(delay)
+	} else {
+		f.ready(j)
+	}
+	return j.id, nil
+}
+
+// reserved returns the job if it is reserved by c.
+func (c *fakeConn) reserved(id uint64) *fakeJob {
+	if j := c.f.jobs[id]; j != nil && j.state == "reserved" && j.owner == c {
+		return j
+	}
+	return nil
+}
+
+func (c *fakeConn) Delete(id uint64) error {
+	f := c.f
+	err := f.begin(c, "delete")
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	j := f.jobs[id]
+	if j == nil || (j.state == "reserved" && j.owner != c) {
+		return notFound("delete")
+	}
+	delete(f.jobs, id)
+	return nil
+}
+
+func (c *fakeConn) Release(id uint64, pri uint32, delay time.Duration) error {
+	f := c.f
+	err := f.begin(c, "release")
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	j := c.reserved(id)
+	if j == nil {
+		return notFound("release")
+	}
+	j.pri, j.delay = pri, delay
+	j.releases++
+	if delay > 0 {
+		j.state, j.owner, j.until = "delayed", nil, time.Now().Add(delay)
+	} else {
+		f.ready(j)
+	}
+	return nil
+}
+
+func (c *fakeConn) Bury(id uint64, pri uint32) error {
+	f := c.f
+	err := f.begin(c, "bury")
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	j := c.reserved(id)
+	if j == nil {
+		return notFound("bury")
+	}
+	j.state, j.owner, j.until, j.pri = "buried", nil, time.Time{}, pri
+	j.buries++
+	return nil
+}
+
+func (c *fakeConn) Touch(id uint64) error {
+	f := c.f
+	err := f.begin(c, "touch")
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	j := c.reserved(id)
+	if j == nil {
+		return notFound("touch")
+	}
+	j.until = time.Now().Add(j.ttr)
+	return nil
+}
+
+func (c *fakeConn) StatsJob(id uint64) (map[string]string, error) {
+	f := c.f
+	err := f.begin(c, "stats-job")
+	defer f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	j := f.jobs[id]
+	if j == nil {
+		return nil, notFound("stats-job")
+	}
+	now := time.Now()
+	var left time.Duration
+	if !j.until.IsZero() {
+		left = j.until.Sub(now)
+	}
+	seconds := func(d time.Duration) string { return strconv.FormatInt(int64(d/time.Second), 10) }
+	count := func(n uint64) string { return strconv.FormatUint(n, 10) }
+	return map[string]string{
+		"id":        count(j.id),
+		"tube":      j.tube,
+		"state":     j.state,
+		"pri":       strconv.FormatUint(uint64(j.pri), 10),
+		"age":       seconds(now.Sub(j.created)),
+		"delay":     seconds(j.delay),
+		"ttr":       seconds(j.ttr),
+		"time-left": seconds(left),
+		"file":      "0",
+		"reserves":  count(j.reserves),
+		"timeouts":  count(j.timeouts),
+		"releases":  count(j.releases),
+		"buries":    count(j.buries),
+		"kicks":     "0",
+	}, nil
+}
+
+func (c *fakeConn) StatsTube(tube string) (map[string]string, error) {
+	f := c.f
+	err := f.begin(c, "stats-tube")
+	defer f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	total := 0
+	for _, j := range f.jobs {
+		if j.tube == tube {
+			counts[j.state]++
+			total++
+		}
+	}
+	if total == 0 {
+		return nil, notFound("stats-tube")
+	}
+	return map[string]string{
+		"name":                  tube,
+		"current-jobs-ready":    strconv.Itoa(counts["ready"]),
+		"current-jobs-reserved": strconv.Itoa(counts["reserved"]),
+		"current-jobs-delayed":  strconv.Itoa(counts["delayed"]),
+		"current-jobs-buried":   strconv.Itoa(counts["buried"]),
+		"pause":                 "0",
+		"pause-time-left":       "0",
+	}, nil
+}
+
+func (c *fakeConn) PeekReady(tube string) (uint64, []byte, error) {
+	return c.peek("peek-ready", "ready", tube)
+}
+
+func (c *fakeConn) PeekDelayed(tube string) (uint64, []byte, error) {
+	return c.peek("peek-delayed", "delayed", tube)
+}
+
+func (c *fakeConn) peek(op, state, tube string) (uint64, []byte, error) {
+	f := c.f
+	err := f.begin(c, op)
+	defer f.mu.Unlock()
+	if err != nil {
+		return 0, nil, err
+	}
+	j := f.next(state, tube)
+	if j == nil {
+		return 0, nil, notFound(op)
+	}
+	return j.id, append([]byte(nil), j.body...), nil
+}
+
+func (c *fakeConn) NewReserver(tubes ...string) Reserver {
+	return fakeReserver{c, append([]string(nil), tubes...)}
+}
+
+// Close the connection, returning the jobs it has reserved to ready. A
+// reserve waiting on it fails, as on a real connection.
+func (c *fakeConn) Close() error {
+	f := c.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	ids := make([]uint64, 0)
+	for id, j := range f.jobs {
+		if j.owner == c {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, k int) bool { return ids[i] < ids[k] })
+	for _, id := range ids {
+		f.ready(f.jobs[id])
+	}
+	f.notify()
+	return nil
+}
+
+// fakeReserver reserves jobs from tubes on a Fake connection.
+type fakeReserver struct {
+	c     *fakeConn
+	tubes []string
+}
+
+// Reserve waits up to timeout for a ready job, answering DEADLINE_SOON if
+// a job the connection has reserved is within a second of its TTR.
+func (r fakeReserver) Reserve(timeout time.Duration) (uint64, []byte, error) {
+	const op = "reserve-with-timeout"
+	f := r.c.f
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := f.begin(r.c, op); err != nil {
+			f.mu.Unlock()
+			return 0, nil, err
+		}
+		now := time.Now()
+		for _, j := range f.jobs {
+			if j.owner == r.c && j.until.Sub(now) <= time.Second {
+				f.mu.Unlock()
+				return 0, nil, beanstalk.ConnError{Op: op, Err: beanstalk.ErrDeadline}
+			}
+		}
+		if j := f.next("ready", r.tubes...); j != nil {
+			j.state, j.owner, j.until = "reserved", r.c, now.Add(j.ttr)
+			j.reserves++
+			body := append([]byte(nil), j.body...)
+			f.mu.Unlock()
+			return j.id, body, nil
+		}
+		if !now.Before(deadline) {
+			f.mu.Unlock()
+			return 0, nil, beanstalk.ConnError{Op: op, Err: beanstalk.ErrTimeout}
+		}
+
+		wait := deadline.Sub(now)
+		if t := f.wake(); !t.IsZero() && t.Sub(now) < wait {
+			wait = max(t.Sub(now), time.Millisecond)
+		}
+		changed := f.changed
+		f.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
@@ -0,0 +1,99 @@
+package bs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kr/beanstalk"
+)
+
+func TestFakeReserveOrder(t *testing.T) {
+	f := NewFake()
+	c := f.Conn()
+	low, _ := c.Put("a", []byte("low"), 100, 0, time.Minute)
+	high, _ := c.Put("a", []byte("high"), 10, 0, time.Minute)
+	c.Put("b", []byte("unwatched"), 0, 0, time.Minute)
+
+	r := c.NewReserver("a")
+	for _, expect := range []uint64{high, low} {
+		id, _, err := r.Reserve(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != expect {
+			t.Fatalf("reserved job %d, expected %d", id, expect)
+		}
+	}
+	if _, _, ok, err := ReserveWithTimeout(r, 0); ok || err != nil {
+		t.Fatalf("expected no job, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestFakeReleaseDelay(t *testing.T) {
+	f := NewFake()
+	c := f.Conn()
+	id, _ := c.Put("a", []byte("job"), 0, 0, time.Minute)
+	r := c.NewReserver("a")
+	r.Reserve(0)
+
+	if err := c.Release(id, 0, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	stats, _ := c.StatsJob(id)
+	if stats["state"] != "delayed" || stats["releases"] != "1" {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+
+	start := time.Now()
+	got, _, err := r.Reserve(time.Second)
+	if err != nil || got != id {
+		t.Fatalf("reserved %d, %v, expected job %d", got, err, id)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("reserved after %v, before the delay ran out", d)
+	}
+}
+
+func TestFakeClose(t *testing.T) {
+	f := NewFake()
+	c1, c2 := f.Conn(), f.Conn()
+	id, _ := c1.Put("a", []byte("job"), 0, 0, time.Minute)
+	c1.NewReserver("a").Reserve(0)
+
+	if err := c2.Release(id, 0, 0); !NotFound(err) {
+		t.Fatalf("expected NOT_FOUND releasing another connection's job, got %v", err)
+	}
+	c1.Close()
+	if err := c1.Delete(id); !ConnectionLost(err) {
+		t.Fatalf("expected a lost connection, got %v", err)
+	}
+	stats, _ := c2.StatsJob(id)
+	if stats["state"] != "ready" {
+		t.Fatalf("job %s, expected ready after its connection closed", stats["state"])
+	}
+	if err := c2.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if f.Len() != 0 {
+		t.Fatalf("%d jobs left, expected none", f.Len())
+	}
+}
+
+func TestFakeFail(t *testing.T) {
+	f := NewFake()
+	c := f.Conn()
+	id, _ := c.Put("a", []byte("job"), 0, 0, time.Minute)
+
+	f.Fail("delete", beanstalk.ErrOOM)
+	if err := c.Delete(id); !Transient(err) {
+		t.Fatalf("expected OUT_OF_MEMORY, got %v", err)
+	}
+	if err := c.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	var connErr beanstalk.ConnError
+	if err := c.Delete(id); !errors.As(err, &connErr) || !NotFound(err) {
+		t.Fatalf("expected NOT_FOUND, got %v", err)
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"strconv"
 	"time"
-
-	"github.com/kr/beanstalk"
 )
 
 // Job represents a beanstalkd job, and holds a reference to the connection so
@@ -18,11 +16,11 @@ type Job struct {
 	// The job payload data.
 	Body []byte
 
-	conn *beanstalk.Conn
+	conn Conn
 }
 
 // Create a Job instance.
-func NewJob(id uint64, body []byte, conn *beanstalk.Conn) Job {
+func NewJob(id uint64, body []byte, conn Conn) Job {
 	return Job{
 		Body: body,
 		Id:   id,
@@ -30,12 +28,23 @@ func NewJob(id uint64, body []byte, conn *beanstalk.Conn) Job {
 	}
 }
 
+// Age of the job since it was put, as a time.Duration.
+func (j Job) Age() (time.Duration, error) {
+	age, err := j.uint64Stat("age")
+	return time.Duration(age) * time.Second, err
+}
+
 // Bury the job, with its original priority.
 func (j Job) Bury() error {
 	pri, err := j.Priority()
 	if err != nil {
 		return err
 	}
+	return j.BuryWithPriority(pri)
+}
+
+// BuryWithPriority buries the job with the specified priority.
+func (j Job) BuryWithPriority(pri uint32) error {
 	return j.conn.Bury(j.Id, pri)
 }
 
@@ -50,12 +59,17 @@ func (j Job) Priority() (uint32, error) {
 	return uint32(pri64), err
 }
 
-// Release the job, with its original priority and no delay.
+// Release the job, with its original priority and the specified delay.
 func (j Job) Release(delay time.Duration) error {
 	pri, err := j.Priority()
 	if err != nil {
 		return err
 	}
+	return j.ReleaseWithPriority(pri, delay)
+}
+
+// ReleaseWithPriority releases the job with the specified priority and delay.
+func (j Job) ReleaseWithPriority(pri uint32, delay time.Duration) error {
 	return j.conn.Release(j.Id, pri, delay)
 }
 
@@ -64,6 +78,17 @@ func (j Job) Releases() (uint64, error) {
 	return j.uint64Stat("releases")
 }
 
+// Reserves counts how many times the job has been reserved, including the
+// current reservation.
+func (j Job) Reserves() (uint64, error) {
+	return j.uint64Stat("reserves")
+}
+
+// Stats of the job, as reported by stats-job.
+func (j Job) Stats() (map[string]string, error) {
+	return j.conn.StatsJob(j.Id)
+}
+
 func (j Job) String() string {
 	stats, err := j.conn.StatsJob(j.Id)
 	if err == nil {
@@ -73,6 +98,15 @@ func (j Job) String() string {
 	}
 }
 
+// Tube the job belongs to.
+func (j Job) Tube() (string, error) {
+	stats, err := j.conn.StatsJob(j.Id)
+	if err != nil {
+		return "", err
+	}
+	return stats["tube"], nil
+}
+
 // TimeLeft as reported by beanstalkd, as a time.Duration.
 // beanstalkd reports as int(seconds), which defines the (low) precision.
 // Less than 1.0 seconds remaining will be reported as zero.
@@ -84,6 +118,17 @@ func (j Job) TimeLeft() (time.Duration, error) {
 	return time.ParseDuration(stats["time-left"] + "s")
 }
 
+// Touch the job, resetting its TTR countdown.
+func (j Job) Touch() error {
+	return j.conn.Touch(j.Id)
+}
+
+// TTR (time-to-run) of the job, as a time.Duration.
+func (j Job) TTR() (time.Duration, error) {
+	ttr, err := j.uint64Stat("ttr")
+	return time.Duration(ttr) * time.Second, err
+}
+
 // Timeouts counts how many times the job has been reserved and reached TTR.
 func (j Job) Timeouts() (uint64, error) {
 	return j.uint64Stat("timeouts")
@@ -94,5 +139,13 @@ func (j Job) uint64Stat(key string) (uint64, error) {
 	if err != nil {
 		return 0, err
 	}
-	return strconv.ParseUint(stats[key], 10, 64)
+	return parseUint64Stat(j.Id, stats, key)
+}
+
+func parseUint64Stat(id uint64, stats map[string]string, key string) (uint64, error) {
+	n, err := strconv.ParseUint(stats[key], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("job %d %s: %w", id, key, err)
+	}
+	return n, nil
 }
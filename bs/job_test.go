@@ -0,0 +1,30 @@
+package bs
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestParseUint64Stat(t *testing.T) {
+	stats := map[string]string{"pri": "1024"}
+	pri, err := parseUint64Stat(1, stats, "pri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pri != 1024 {
+		t.Fatalf("pri %d, expected 1024", pri)
+	}
+}
+
+func TestParseUint64StatMalformed(t *testing.T) {
+	stats := map[string]string{"pri": "urgent"}
+	_, err := parseUint64Stat(1, stats, "pri")
+	if err == nil {
+		t.Fatal("expected error for non-numeric pri")
+	}
+	var numErr *strconv.NumError
+	if !errors.As(err, &numErr) {
+		t.Fatalf("expected *strconv.NumError, got %T: %s", err, err)
+	}
+}
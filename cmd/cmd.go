@@ -4,6 +4,7 @@
 package cmd
 
 import (
+	"errors"
 	"io"
 	"os"
 	"os/exec"
@@ -20,60 +21,146 @@ type Cmd struct {
 	stderrPipe io.ReadCloser
 	stdinPipe  io.WriteCloser
 	stdoutPipe io.ReadCloser
+	stdinErr   chan error
 }
 
 // WaitResult is sent to the channel returned by WaitChan().
 // It indicates the exit status, or a non-exit-status error e.g. IO error.
 // In the case of a non-exit-status, Status is -1
+// If the process was killed by a signal, Status is -1 and Signal is set.
 type WaitResult struct {
 	Status int
 	Err    error
+	Signal syscall.Signal
 }
 
 // NewCommand returns a Cmd with IO configured, but not started.
-func NewCommand(shellCmd string) (cmd *Cmd, out <-chan []byte, err error) {
-	cmd = &Cmd{}
-	cmd.cmd = exec.Command(Shell, "-c", shellCmd)
+// Output from stdout and stderr is sent to the respective channels, which
+// are closed when the stream reaches EOF. Stderr is also passed through to
+// os.Stderr as it is read.
+func NewCommand(shellCmd string) (cmd *Cmd, out, errOut <-chan []byte, err error) {
+	return NewArgvCommand([]string{Shell, "-c", shellCmd})
+}
 
-	stdin, err := cmd.cmd.StdinPipe()
-	if err == nil {
-		cmd.stdinPipe = stdin
-	} else {
+// NewArgvCommand is like NewCommand, but executes argv[0] directly with the
+// remaining arguments, rather than passing a command line to Shell.
+func NewArgvCommand(argv []string) (cmd *Cmd, out, errOut <-chan []byte, err error) {
+	return newArgvCommand(argv, true)
+}
+
+// NewArgvCommandDiscardStdout is like NewArgvCommand, but the process's
+// stdout is /dev/null, and out is nil.
+func NewArgvCommandDiscardStdout(argv []string) (cmd *Cmd, out, errOut <-chan []byte, err error) {
+	return newArgvCommand(argv, false)
+}
+
+func newArgvCommand(argv []string, captureStdout bool) (cmd *Cmd, out, errOut <-chan []byte, err error) {
+	if len(argv) == 0 {
+		err = errors.New("empty command")
 		return
 	}
 
-	stdout, err := cmd.cmd.StdoutPipe()
-	if err == nil {
+	cmd = &Cmd{}
+	cmd.cmd = exec.Command(argv[0], argv[1:]...)
+
+	// Run in a new process group so that Kill reaches any children.
+	setProcessGroup(cmd.cmd)
+
+	if captureStdout {
+		stdout, err := cmd.cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, nil, err
+		}
 		cmd.stdoutPipe = stdout
+	}
+
+	stderr, err := cmd.cmd.StderrPipe()
+	if err == nil {
+		cmd.stderrPipe = stderr
 	} else {
 		return
 	}
 
-	cmd.cmd.Stderr = os.Stderr
-	cmd.stderrPipe = os.Stderr
-
-	out = readerToChannel(cmd.stdoutPipe)
+	if captureStdout {
+		out = readerToChannel(cmd.stdoutPipe)
+	}
+	errOut = readerToChannel(io.TeeReader(cmd.stderrPipe, os.Stderr))
 	return
 }
 
-// Start the process, write input to stdin, then close stdin.
+// AddEnv adds "KEY=value" variables to the environment inherited from this
+// process. It must be called before the process is started.
+func (c *Cmd) AddEnv(env ...string) {
+	if len(env) == 0 {
+		return
+	}
+	if c.cmd.Env == nil {
+		c.cmd.Env = os.Environ()
+	}
+	c.cmd.Env = append(c.cmd.Env, env...)
+}
+
+// SetDir sets the working directory of the process.
+// It must be called before the process is started.
+func (c *Cmd) SetDir(dir string) {
+	c.cmd.Dir = dir
+}
+
+// Start the process, then write input to stdin and close it from a separate
+// goroutine, so that output can be read while the write is in progress.
+// Empty input closes stdin without a write. The outcome of the write is
+// available from StdinDone.
 func (c *Cmd) StartWithStdin(input []byte) (err error) {
-	err = c.cmd.Start()
+	c.stdinPipe, err = c.cmd.StdinPipe()
 	if err != nil {
 		return
 	}
-	_, err = c.stdinPipe.Write(input)
+	err = c.cmd.Start()
 	if err != nil {
 		return
 	}
-	c.stdinPipe.Close()
+	c.stdinErr = make(chan error, 1)
+	if len(input) == 0 {
+		c.stdinErr <- c.stdinPipe.Close()
+		return nil
+	}
+	go func() {
+		_, err := c.stdinPipe.Write(input)
+		if closeErr := c.stdinPipe.Close(); err == nil {
+			err = closeErr
+		}
+		c.stdinErr <- err
+	}()
 	return nil
 }
 
-// Terminate the process with SIGTERM.
+// StartWithNullStdin starts the process with /dev/null as stdin.
+func (c *Cmd) StartWithNullStdin() error {
+	c.stdinErr = make(chan error, 1)
+	c.stdinErr <- nil
+	return c.cmd.Start()
+}
+
+// StdinDone receives the outcome of the stdin write started by
+// StartWithStdin once it finishes.
+func (c *Cmd) StdinDone() <-chan error {
+	return c.stdinErr
+}
+
+// Terminate the process and the rest of its process group with SIGTERM.
 // TODO: follow up with SIGKILL if still running.
 func (c *Cmd) Terminate() (err error) {
-	return c.cmd.Process.Signal(syscall.SIGTERM)
+	return c.Signal(syscall.SIGTERM)
+}
+
+// Signal the process and the rest of its process group.
+func (c *Cmd) Signal(sig syscall.Signal) error {
+	return signalGroup(c.cmd.Process, sig)
+}
+
+// Kill the process and the rest of its process group with SIGKILL.
+func (c *Cmd) Kill() (err error) {
+	return signalGroup(c.cmd.Process, syscall.SIGKILL)
 }
 
 // WaitChan starts a goroutine to wait for the command to exit, and returns
@@ -84,12 +171,11 @@ func (cmd *Cmd) WaitChan() <-chan WaitResult {
 	go func() {
 		err := cmd.cmd.Wait()
 		if err == nil {
-			ch <- WaitResult{0, nil}
-		} else if e1, ok := err.(*exec.ExitError); ok {
-			status := e1.Sys().(syscall.WaitStatus).ExitStatus()
-			ch <- WaitResult{status, nil}
+			ch <- WaitResult{0, nil, 0}
+		} else if status, ok := exitStatus(err); ok {
+			ch <- WaitResult{status, nil, exitSignal(err)}
 		} else {
-			ch <- WaitResult{-1, err}
+			ch <- WaitResult{-1, err, 0}
 		}
 	}()
 	return ch
@@ -0,0 +1,85 @@
+//go:build unix
+
+package cmd
+
+import (
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestStderrPassThrough demonstrates stderr being sent to errOut and also
+// written to os.Stderr.
+func TestStderrPassThrough(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	cmd, out, errOut, err := NewArgvCommand([]string{"/bin/sh", "-c", "echo -n oops >&2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.StartWithNullStdin(); err != nil {
+		t.Fatal(err)
+	}
+	for range out {
+	}
+	var captured []byte
+	for data := range errOut {
+		captured = append(captured, data...)
+	}
+	<-cmd.WaitChan()
+	w.Close()
+
+	passed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(captured) != "oops" || string(passed) != "oops" {
+		t.Fatalf("captured %q and passed through %q, expected %q for both", captured, passed, "oops")
+	}
+}
+
+// TestProcessCloseTimeout demonstrates Close killing a process that keeps
+// running after its stdin is closed.
+func TestProcessCloseTimeout(t *testing.T) {
+	p, err := StartProcess([]string{"/bin/sh", "-c", "sleep 30 & wait"}, nil, "", io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	wr := p.Close(50 * time.Millisecond)
+	if wr.Signal != syscall.SIGKILL {
+		t.Fatalf("expected SIGKILL, got %+v", wr)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("Close took %s", d)
+	}
+}
+
+// TestProcessOutputTooLong demonstrates Exchange refusing a response header
+// claiming more than MaxOutputBytes of output, rather than allocating it.
+func TestProcessOutputTooLong(t *testing.T) {
+	script := `read id len; head -c "$len" >/dev/null; echo "0 1073741824"; sleep 30`
+	p, err := StartProcess([]string{"/bin/sh", "-c", script}, nil, "", io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Kill()
+
+	_, output, err := p.Exchange(1, []byte("hello"))
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Fatalf("expected the response length to be refused, got %v", err)
+	}
+	if output != nil {
+		t.Fatalf("expected no output, got %d bytes", len(output))
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package cmd
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// exitStatus extracts the exit status from the error returned by Wait, or
+// returns false if the process didn't exit, e.g. an IO error.
+func exitStatus(err error) (int, bool) {
+	var e *exec.ExitError
+	if !errors.As(err, &e) {
+		return 0, false
+	}
+	return e.ExitCode(), true
+}
+
+// exitSignal always returns 0, signals not being reported on this platform.
+func exitSignal(err error) syscall.Signal {
+	return 0
+}
@@ -0,0 +1,36 @@
+//go:build unix
+
+package cmd
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// exitStatus extracts the exit status from the error returned by Wait, or
+// returns false if the process didn't exit, e.g. an IO error. A process
+// killed by a signal has status -1.
+func exitStatus(err error) (int, bool) {
+	var e *exec.ExitError
+	if !errors.As(err, &e) {
+		return 0, false
+	}
+	if ws, ok := e.Sys().(syscall.WaitStatus); ok {
+		return ws.ExitStatus(), true
+	}
+	return e.ExitCode(), true
+}
+
+// exitSignal extracts the signal which killed the process from the error
+// returned by Wait, or returns 0.
+func exitSignal(err error) syscall.Signal {
+	var e *exec.ExitError
+	if !errors.As(err, &e) {
+		return 0
+	}
+	if ws, ok := e.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ws.Signal()
+	}
+	return 0
+}
@@ -0,0 +1,39 @@
+//go:build unix
+
+package cmd
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+func TestExitStatus(t *testing.T) {
+	err := exec.Command("/bin/sh", "-c", "exit 3").Run()
+	if status, ok := exitStatus(err); !ok || status != 3 {
+		t.Fatalf("exitStatus = %d, %v, expected 3, true", status, ok)
+	}
+	if sig := exitSignal(err); sig != 0 {
+		t.Fatalf("exitSignal = %v, expected none", sig)
+	}
+}
+
+func TestExitStatusSignaled(t *testing.T) {
+	err := exec.Command("/bin/sh", "-c", "kill -TERM $$").Run()
+	if status, ok := exitStatus(err); !ok || status != -1 {
+		t.Fatalf("exitStatus = %d, %v, expected -1, true", status, ok)
+	}
+	if sig := exitSignal(err); sig != syscall.SIGTERM {
+		t.Fatalf("exitSignal = %v, expected %v", sig, syscall.SIGTERM)
+	}
+}
+
+func TestExitStatusNotExited(t *testing.T) {
+	if _, ok := exitStatus(errors.New("read failed")); ok {
+		t.Fatal("expected a non-exit error not to have a status")
+	}
+	if _, ok := exitStatus(nil); ok {
+		t.Fatal("expected nil not to have a status")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup does nothing, process groups not being supported on this
+// platform.
+func setProcessGroup(c *exec.Cmd) {}
+
+// signalGroup sends sig to p alone, which may not be supported for signals
+// other than SIGKILL on this platform.
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		return p.Kill()
+	}
+	return p.Signal(sig)
+}
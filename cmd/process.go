@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MaxOutputBytes is the longest response output a Process will accept, so
+// that a corrupt header can't make it allocate an arbitrary amount.
+const MaxOutputBytes = 64 << 20
+
+/*
+Process is a long-lived command which handles many jobs, one at a time,
+exchanging length-prefixed frames over its stdin and stdout.
+
+For each job a request frame is written to stdin: a header line of the job
+id and body length in bytes, separated by a space, followed by exactly that
+many bytes of body:
+
+	<id> <length>\n<body>
+
+The command replies on stdout with a response frame: a header line of its
+status, an integer interpreted like an exit status, and the length of its
+output, followed by exactly that many bytes of output:
+
+	<status> <length>\n<output>
+
+Bodies and output may contain anything, including newlines; nothing follows
+them before the next header. Output longer than MaxOutputBytes is refused as
+a protocol error. Stderr is passed through as it is written.
+*/
+type Process struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	waitC  <-chan WaitResult
+}
+
+// StartProcess starts argv as a Process, with env added to the environment
+// inherited from this process, in dir if it is not empty. Its stderr is
+// copied to stderr.
+func StartProcess(argv []string, env []string, dir string, stderr io.Writer) (*Process, error) {
+	if len(argv) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	c := exec.Command(argv[0], argv[1:]...)
+	setProcessGroup(c)
+	c.Dir = dir
+	if len(env) > 0 {
+		c.Env = append(os.Environ(), env...)
+	}
+	c.Stderr = stderr
+
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &Process{cmd: c, stdin: stdin, stdout: bufio.NewReader(stdout)}
+	p.waitC = (&Cmd{cmd: c}).WaitChan()
+	return p, nil
+}
+
+// Exchange writes a request frame for the job to the process, and reads its
+// response frame. An error means the process can't be relied on for further
+// jobs, e.g. it exited or broke the framing, and should be killed.
+func (p *Process) Exchange(id uint64, body []byte) (status int, output []byte, err error) {
+	w := bufio.NewWriter(p.stdin)
+	fmt.Fprintf(w, "%d %d\n", id, len(body))
+	w.Write(body)
+	if err = w.Flush(); err != nil {
+		return -1, nil, fmt.Errorf("writing request: %w", err)
+	}
+
+	header, err := p.stdout.ReadString('\n')
+	if err != nil {
+		return -1, nil, fmt.Errorf("reading response header: %w", err)
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return -1, nil, fmt.Errorf("malformed response header %q", header)
+	}
+	if status, err = strconv.Atoi(fields[0]); err != nil {
+		return -1, nil, fmt.Errorf("malformed response status %q", fields[0])
+	}
+	n, err := strconv.ParseUint(fields[1], 10, 31)
+	if err != nil {
+		return -1, nil, fmt.Errorf("malformed response length %q", fields[1])
+	}
+	if n > MaxOutputBytes {
+		return -1, nil, fmt.Errorf("response length %d exceeds %d bytes", n, MaxOutputBytes)
+	}
+
+	// ReadFull keeps reading until the whole frame has arrived, however the
+	// process happened to split its writes.
+	output = make([]byte, n)
+	if _, err = io.ReadFull(p.stdout, output); err != nil {
+		return -1, nil, fmt.Errorf("reading response output: %w", err)
+	}
+	return status, output, nil
+}
+
+// Kill the process and the rest of its process group with SIGKILL, and wait
+// for it to exit.
+func (p *Process) Kill() error {
+	err := signalGroup(p.cmd.Process, syscall.SIGKILL)
+	<-p.waitC
+	return err
+}
+
+// Close the process's stdin, signalling it to exit once it has finished,
+// and wait up to timeout for it to do so. If it is still running after
+// that, it and the rest of its process group are killed with SIGKILL.
+func (p *Process) Close(timeout time.Duration) WaitResult {
+	p.stdin.Close()
+	select {
+	case wr := <-p.waitC:
+		return wr
+	case <-time.After(timeout):
+	}
+	signalGroup(p.cmd.Process, syscall.SIGKILL)
+	return <-p.waitC
+}
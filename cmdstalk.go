@@ -5,9 +5,9 @@
 	library to interact with the [beanstalkd][beanstalkd] queue daemon.
 
 	Each job is passed as stdin to a new instance of the configured worker
-	command.  On `exit(0)` the job is deleted. On `exit(1)` (or any non-zero
-	status) the job is released with an exponential-backoff delay (releases^4),
-	up to 10 times.
+	command.  On `exit(0)` the job is deleted. On `exit(1)` the job is released
+	with an exponential-backoff delay (releases^4), up to 10 times. On any other
+	non-zero status the job is buried, preserving it for inspection.
 
 	If the worker has not finished by the time the job TTR is reached, the
 	worker is killed (SIGTERM, SIGKILL) and the job is allowed to time out.